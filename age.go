@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const (
+	AgeSourceName      = "name"
+	AgeSourceCreation  = "creation"
+	AgeSourceTimestamp = "timestamp"
+)
+
+func validateAgeSources(sources []string) error {
+	if len(sources) == 0 {
+		return fmt.Errorf("at least one age source is required")
+	}
+	for _, source := range sources {
+		switch source {
+		case AgeSourceName, AgeSourceCreation, AgeSourceTimestamp:
+		default:
+			return fmt.Errorf("unknown age source %s, should be one of name, creation, timestamp", source)
+		}
+	}
+	return nil
+}
+
+// indexAge resolves the period of an index from age sources in order, the first source giving a date wins,
+// ok is false if no source gives a date
+func (r *Reconciler) indexAge(ctx context.Context, info IndexInfo, dates *dateParser) (period indexPeriod, source string, ok bool) {
+	for _, source = range r.Options.AgeSources {
+		switch source {
+		case AgeSourceName:
+			if period, ok = dates.Parse(info.Name); ok {
+				return
+			}
+		case AgeSourceCreation:
+			if !info.CreationDate.IsZero() {
+				period, ok = dayPeriod(info.CreationDate.In(dates.Location()), source), true
+				return
+			}
+		case AgeSourceTimestamp:
+			t, found, err := r.Indices.NewestTimestamp(ctx, info.Name, r.Options.TimestampField)
+			if err != nil {
+				r.log().WithError(err).With(Fields{"index": info.Name, "field": r.Options.TimestampField}).Warn("Failed to get newest timestamp")
+				continue
+			}
+			if found {
+				period, ok = dayPeriod(t.In(dates.Location()), source), true
+				return
+			}
+		}
+	}
+	source = ""
+	return
+}
+
+// dayPeriod returns the period of the day containing t
+func dayPeriod(t time.Time, pattern string) indexPeriod {
+	start := dateMidnight(t)
+	return indexPeriod{Pattern: pattern, Start: start, End: start.AddDate(0, 0, 1)}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"strings"
+)
+
+const (
+	// manifestKey is the key of manifest in result configmap of task
+	manifestKey = "manifest.json"
+
+	VerificationVerified   = "verified"
+	VerificationSuspicious = "suspicious"
+
+	ManifestSourceConfigMap   = "configmap"
+	ManifestSourceTermination = "termination-message"
+)
+
+// Manifest is the result of a task, written by esbridge as json to its result configmap,
+// named by env ESBRIDGE_RESULT_CONFIGMAP, or to the termination message of its container
+type Manifest struct {
+	DocsCount int64  `json:"docs_count"`
+	Bytes     int64  `json:"bytes"`
+	Checksum  string `json:"checksum"`
+	Location  string `json:"location"`
+}
+
+// Verification is the result of comparing manifest of a completed task with its index
+type Verification struct {
+	Status   string    `json:"status"`
+	Reason   string    `json:"reason,omitempty"`
+	Manifest *Manifest `json:"manifest,omitempty"`
+	// Source of manifest, configmap or termination-message
+	Source string `json:"source,omitempty"`
+}
+
+// resultConfigMapName returns name of the configmap task writes its manifest to
+func resultConfigMapName(taskName string) string {
+	return taskName + "-result"
+}
+
+// taskPod returns the latest pod of job in phase, or any phase if phase is empty
+func taskPod(job batchv1.Job, pods []corev1.Pod, phase corev1.PodPhase) *corev1.Pod {
+	var latest *corev1.Pod
+	for i, pod := range pods {
+		if pod.Labels["job-name"] != job.Name && pod.Annotations[indexAnnotationKey] != job.Annotations[indexAnnotationKey] {
+			continue
+		}
+		if phase != "" && pod.Status.Phase != phase {
+			continue
+		}
+		if latest == nil || latest.CreationTimestamp.Before(&pod.CreationTimestamp) {
+			latest = &pods[i]
+		}
+	}
+	return latest
+}
+
+// podManifest parses manifest from termination message of containers in pod
+func podManifest(pod *corev1.Pod) (m Manifest, err error) {
+	for _, status := range pod.Status.ContainerStatuses {
+		if status.State.Terminated == nil || strings.TrimSpace(status.State.Terminated.Message) == "" {
+			continue
+		}
+		if err = json.Unmarshal([]byte(status.State.Terminated.Message), &m); err != nil {
+			err = fmt.Errorf("invalid manifest in termination message of %s: %s", pod.Name, err.Error())
+		}
+		return
+	}
+	err = fmt.Errorf("no manifest in termination message of %s", pod.Name)
+	return
+}
+
+// verifyArchive compares manifest reported by task with the index
+func verifyArchive(m Manifest, info IndexInfo) error {
+	if m.DocsCount != info.DocsCount {
+		return fmt.Errorf("archived %d docs, index has %d", m.DocsCount, info.DocsCount)
+	}
+	if m.DocsCount > 0 && m.Bytes <= 0 {
+		return fmt.Errorf("archived %d docs in %d bytes", m.DocsCount, m.Bytes)
+	}
+	if m.Checksum == "" {
+		return fmt.Errorf("missing checksum")
+	}
+	if m.Location == "" {
+		return fmt.Errorf("missing location")
+	}
+	return nil
+}
+
+// verifyTask reads manifest of a completed task from its result configmap or termination message of its pod,
+// and compares it with the index, hasConfigMap is true if the result configmap exists
+func (r *Reconciler) verifyTask(ctx context.Context, job batchv1.Job, pods []corev1.Pod, infos map[string]IndexInfo) (v Verification, hasConfigMap bool) {
+	index := job.Annotations[indexAnnotationKey]
+
+	var (
+		manifest Manifest
+		err      error
+	)
+	cm, errCM := r.Kube.CoreV1().ConfigMaps(r.Options.Namespace).Get(ctx, resultConfigMapName(job.Name), metav1.GetOptions{})
+	switch {
+	case errCM == nil:
+		hasConfigMap = true
+		if err = json.Unmarshal([]byte(cm.Data[manifestKey]), &manifest); err != nil {
+			err = fmt.Errorf("invalid manifest in configmap %s: %s", cm.Name, err.Error())
+		} else {
+			v.Source = ManifestSourceConfigMap
+		}
+	case apierrors.IsNotFound(errCM):
+		if pod := taskPod(job, pods, corev1.PodSucceeded); pod == nil {
+			err = fmt.Errorf("no result configmap or succeeded pod of %s", job.Name)
+		} else if manifest, err = podManifest(pod); err == nil {
+			v.Source = ManifestSourceTermination
+		}
+	default:
+		err = fmt.Errorf("failed to get result configmap of %s: %s", job.Name, errCM.Error())
+	}
+
+	if err == nil {
+		v.Manifest = &manifest
+		if info, ok := infos[index]; !ok {
+			err = fmt.Errorf("index %s not found in elasticsearch", index)
+		} else {
+			err = verifyArchive(manifest, info)
+		}
+	}
+
+	if err != nil {
+		v.Status, v.Reason = VerificationSuspicious, err.Error()
+		r.log().With(Fields{"index": index, "reason": v.Reason}).Warn("Suspicious")
+	} else {
+		v.Status = VerificationVerified
+		r.log().With(Fields{"index": index, "docs": manifest.DocsCount, "location": manifest.Location}).Info("Verified")
+	}
+	return
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"net/url"
+	"os"
+	"sigs.k8s.io/yaml"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	envPrefix = "ESBRIDGECTL_"
+)
+
+// Config is the full configuration, precedence from low to high: defaults, config file, environment variables, flags
+type Config struct {
+	ESURL      string          `json:"esURL"`
+	Kubeconfig string          `json:"kubeconfig"`
+	Loop       bool            `json:"loop"`
+	Resync     metav1.Duration `json:"resync"`
+	// MetricsAddr serves /metrics in controller mode, e.g. :9090
+	MetricsAddr string `json:"metricsAddr"`
+	// MetricsPush is the pushgateway url metrics are pushed to after a single pass
+	MetricsPush string `json:"metricsPush"`
+	// MetricsTextfile is the file metrics are written to after a single pass, for node exporter textfile collector
+	MetricsTextfile string `json:"metricsTextfile"`
+	// LogFormat is text or json
+	LogFormat string `json:"logFormat"`
+
+	Options
+}
+
+// DefaultConfig returns the config with all default values
+func DefaultConfig() *Config {
+	return &Config{
+		ESURL:      "http://127.0.0.1:9200",
+		Kubeconfig: "kubeconfig",
+		Resync:     metav1.Duration{Duration: time.Minute * 10},
+		LogFormat:  LogFormatText,
+		Options: Options{
+			Namespace:       "esmaint",
+			Tasks:           4,
+			Days:            95,
+			DatePatterns:    []DatePattern{{Name: "daily"}},
+			Timezone:        "Local",
+			AgeSources:      []string{AgeSourceName},
+			TimestampField:  "@timestamp",
+			ClosedIndices:   IndexPolicySkip,
+			RedIndices:      IndexPolicySkip,
+			ConfigMap:       "esbridge-cfg",
+			ConfigMapKey:    "esbridge.yml",
+			StorageClass:    "local-path",
+			StorageRequest:  "200Gi",
+			StorageMin:      "1Gi",
+			StorageMax:      "2Ti",
+			Image:           "guoyk/esbridge",
+			ImagePullPolicy: corev1.PullAlways,
+			DataMount:       "/data",
+			Batch:           "2000",
+			NotifyRetries:   3,
+			Ledger:          "esbridgectl-ledger",
+			RetryBackoff:    metav1.Duration{Duration: time.Minute * 30},
+			RetryBackoffMax: metav1.Duration{Duration: time.Hour * 24},
+			MaxAttempts:     5,
+			NotifyLogLines:  20,
+			FailedLogLines:  100,
+			Resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{
+					corev1.ResourceCPU:    resource.MustParse("2"),
+					corev1.ResourceMemory: resource.MustParse("2000Mi"),
+				},
+				Limits: corev1.ResourceList{
+					corev1.ResourceCPU:    resource.MustParse("2"),
+					corev1.ResourceMemory: resource.MustParse("6000Mi"),
+				},
+			},
+			PodAnnotations: map[string]string{
+				"tke.cloud.tencent.com/vpc-ip-claim-delete-policy": "Immediate",
+			},
+			Priority: []PriorityGroup{
+				{Pattern: "*info-prod-*", Weight: 50},
+				{Pattern: "*info-production-*", Weight: 40},
+				{Pattern: "*access-prod-*", Weight: 30},
+				{Pattern: "*access-production-*", Weight: 20},
+				{Pattern: "*-prod*", Weight: 10},
+			},
+			TieBreaker: TieBreakerOldestFirst,
+		},
+	}
+}
+
+// LoadConfigFile loads yaml config file onto cfg, unknown fields are rejected,
+// default resource requests, resource limits and pod annotations are replaced as a whole if set in file
+func LoadConfigFile(file string, cfg *Config) (err error) {
+	var buf []byte
+	if buf, err = ioutil.ReadFile(file); err != nil {
+		return
+	}
+
+	// unmarshalling merges into non-nil maps, fill map defaults only if file leaves them unset
+	requests, limits, podAnnotations := cfg.Resources.Requests, cfg.Resources.Limits, cfg.PodAnnotations
+	cfg.Resources.Requests, cfg.Resources.Limits, cfg.PodAnnotations = nil, nil, nil
+
+	if err = yaml.UnmarshalStrict(buf, cfg); err != nil {
+		err = fmt.Errorf("invalid config file %s: %s", file, err.Error())
+		return
+	}
+
+	if cfg.Resources.Requests == nil {
+		cfg.Resources.Requests = requests
+	}
+	if cfg.Resources.Limits == nil {
+		cfg.Resources.Limits = limits
+	}
+	if cfg.PodAnnotations == nil {
+		cfg.PodAnnotations = podAnnotations
+	}
+	return
+}
+
+// Validate checks the config for invalid values
+func (c *Config) Validate() error {
+	var errs []string
+	if u, err := url.Parse(c.ESURL); err != nil || u.Scheme == "" || u.Host == "" {
+		errs = append(errs, "esURL: invalid url "+c.ESURL)
+	}
+	if c.Resync.Duration <= 0 {
+		errs = append(errs, "resync: must be positive")
+	}
+	if c.MetricsPush != "" {
+		if u, err := url.Parse(c.MetricsPush); err != nil || u.Scheme == "" || u.Host == "" {
+			errs = append(errs, "metricsPush: invalid url "+c.MetricsPush)
+		}
+	}
+	if err := validateLogFormat(c.LogFormat); err != nil {
+		errs = append(errs, "logFormat: "+err.Error())
+	}
+	if c.Namespace == "" {
+		errs = append(errs, "namespace: required")
+	}
+	if c.Tasks < 0 {
+		errs = append(errs, "tasks: must not be negative")
+	}
+	if c.Days < 0 {
+		errs = append(errs, "days: must not be negative")
+	}
+	if _, err := newRetentionPolicy(c.Retention, c.Days); err != nil {
+		errs = append(errs, "retention: "+err.Error())
+	}
+	if _, err := newDateParser(c.DatePatterns, c.Timezone); err != nil {
+		errs = append(errs, "datePatterns, timezone: "+err.Error())
+	}
+	if err := validateAgeSources(c.AgeSources); err != nil {
+		errs = append(errs, "ageSources: "+err.Error())
+	}
+	if c.TimestampField == "" {
+		errs = append(errs, "timestampField: required")
+	}
+	if _, err := newPriorityPolicy(c.Priority, c.TieBreaker); err != nil {
+		errs = append(errs, "priority, tieBreaker: "+err.Error())
+	}
+	if _, err := newProfilePolicy(c.Profiles); err != nil {
+		errs = append(errs, "profiles: "+err.Error())
+	}
+	for _, profile := range c.Profiles {
+		if err := validateEnv(profile.Env); err != nil {
+			errs = append(errs, "profiles: "+profile.Name+": "+err.Error())
+		}
+		// profile resources override the defaults by name, the merged ones are what the task container gets
+		container := corev1.Container{Resources: *c.Resources.DeepCopy()}
+		profile.apply(&container)
+		for _, name := range requestsOverLimits(container.Resources) {
+			errs = append(errs, fmt.Sprintf("profiles: %s: request of %s exceeds limit", profile.Name, name))
+		}
+	}
+	if err := validateEnv(c.Env); err != nil {
+		errs = append(errs, "env: "+err.Error())
+	}
+	if err := validateIndexPolicy(c.ClosedIndices); err != nil {
+		errs = append(errs, "closedIndices: "+err.Error())
+	}
+	if err := validateIndexPolicy(c.RedIndices); err != nil {
+		errs = append(errs, "redIndices: "+err.Error())
+	}
+	if c.Image == "" {
+		errs = append(errs, "image: required")
+	}
+	switch c.ImagePullPolicy {
+	case corev1.PullAlways, corev1.PullIfNotPresent, corev1.PullNever:
+	default:
+		errs = append(errs, "imagePullPolicy: must be one of Always, IfNotPresent, Never")
+	}
+	if _, err := resource.ParseQuantity(c.StorageRequest); err != nil {
+		errs = append(errs, "storageRequest: "+err.Error())
+	}
+	if c.StorageFactor < 0 {
+		errs = append(errs, "storageFactor: must not be negative")
+	}
+	storageMin, errMin := resource.ParseQuantity(c.StorageMin)
+	if errMin != nil {
+		errs = append(errs, "storageMin: "+errMin.Error())
+	}
+	storageMax, errMax := resource.ParseQuantity(c.StorageMax)
+	if errMax != nil {
+		errs = append(errs, "storageMax: "+errMax.Error())
+	}
+	if errMin == nil && errMax == nil && storageMin.Cmp(storageMax) > 0 {
+		errs = append(errs, "storageMin, storageMax: min exceeds max")
+	}
+	if c.StorageBudget != "" {
+		if _, err := resource.ParseQuantity(c.StorageBudget); err != nil {
+			errs = append(errs, "storageBudget: "+err.Error())
+		}
+	}
+	for node, quantity := range c.NodeBudgets {
+		if _, err := resource.ParseQuantity(quantity); err != nil {
+			errs = append(errs, "nodeBudgets: "+node+": "+err.Error())
+		}
+	}
+	if c.Ledger == "" {
+		errs = append(errs, "ledger: required")
+	}
+	if c.RetryBackoff.Duration < 0 || c.RetryBackoffMax.Duration < 0 {
+		errs = append(errs, "retryBackoff, retryBackoffMax: must not be negative")
+	}
+	if c.FailedLogLines < 0 {
+		errs = append(errs, "failedLogLines: must not be negative")
+	}
+	if c.KeepFailed.Duration < 0 {
+		errs = append(errs, "keepFailed: must not be negative")
+	}
+	if c.MaxAttempts < 0 {
+		errs = append(errs, "maxAttempts: must not be negative")
+	}
+	if _, err := compileIndexPatterns(c.ForceReindex); err != nil {
+		errs = append(errs, "forceReindex: "+err.Error())
+	}
+	if err := validatePodTemplate(c.filePodTemplate, c.PodTemplate); err != nil {
+		errs = append(errs, "podTemplateFile, podTemplate: "+err.Error())
+	}
+	if c.ConfigMap == "" || c.ConfigMapKey == "" {
+		errs = append(errs, "configMap, configMapKey: required")
+	}
+	if !strings.HasPrefix(c.DataMount, "/") {
+		errs = append(errs, "dataMount: must be an absolute path")
+	}
+	if c.NotifyURL != "" {
+		if u, err := url.Parse(c.NotifyURL); err != nil || u.Scheme == "" || u.Host == "" {
+			errs = append(errs, "notifyURL: invalid url "+c.NotifyURL)
+		}
+	}
+	if _, err := newNotifiers(Options{Notifiers: c.Notifiers}); err != nil {
+		errs = append(errs, "notifiers: "+err.Error())
+	}
+	if c.NotifyRetries < 0 {
+		errs = append(errs, "notifyRetries: must not be negative")
+	}
+	for _, name := range requestsOverLimits(c.Resources) {
+		errs = append(errs, fmt.Sprintf("resources: request of %s exceeds limit", name))
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// requestsOverLimits returns sorted names of resources requested more than their limits
+func requestsOverLimits(res corev1.ResourceRequirements) (names []string) {
+	for name, quantity := range res.Requests {
+		if limit, ok := res.Limits[name]; ok && quantity.Cmp(limit) > 0 {
+			names = append(names, string(name))
+		}
+	}
+	sort.Strings(names)
+	return
+}
+
+// commaList is a flag.Value for comma separated list
+type commaList []string
+
+func (l *commaList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *commaList) Set(s string) error {
+	*l = nil
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// appendList is a flag.Value for comma separated list, each flag adds items not in the list yet
+type appendList []string
+
+func (l *appendList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *appendList) Set(s string) error {
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" && !containsStr(*l, item) {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+func (c *Config) register(fs *flag.FlagSet) {
+	fs.BoolVar(&c.DryRun, "dry-run", c.DryRun, "dry run")
+	fs.StringVar(&c.Image, "image", c.Image, "container image")
+	fs.StringVar(&c.ESURL, "es-url", c.ESURL, "elasticsearch url")
+	fs.StringVar(&c.Kubeconfig, "kubeconfig", c.Kubeconfig, "kubeconfig file")
+	fs.StringVar(&c.Namespace, "namespace", c.Namespace, "namespace in kubernetes cluster")
+	fs.IntVar(&c.Tasks, "tasks", c.Tasks, "maximum concurrent tasks")
+	fs.IntVar(&c.Days, "days", c.Days, "keep days of indices")
+	fs.Var((*retentionRules)(&c.Retention), "retention", "keep days by index pattern, comma separated, first match wins, e.g. access-prod-*=180d,debug-*=14d")
+	fs.Var((*datePatternNames)(&c.DatePatterns), "date-patterns", "builtin date patterns of index names, comma separated, first match wins, from daily, hourly, weekly, monthly")
+	fs.StringVar(&c.Timezone, "timezone", c.Timezone, "timezone of index dates, e.g. Asia/Shanghai")
+	fs.Var((*commaList)(&c.AgeSources), "age-source", "sources of index age, comma separated, first giving a date wins, from name, creation, timestamp")
+	fs.StringVar(&c.TimestampField, "timestamp-field", c.TimestampField, "date field for timestamp age source")
+	fs.StringVar(&c.StorageBudget, "storage-budget", c.StorageBudget, "maximum total pvc size of ongoing tasks, empty for unlimited")
+	fs.Var((*nodeBudgets)(&c.NodeBudgets), "node-budgets", "maximum pvc size of ongoing tasks per node, comma separated, tasks are pinned to nodes, e.g. node-1=2Ti,node-2=1Ti")
+	fs.Var((*priorityGroups)(&c.Priority), "priority", "weights by index pattern, comma separated, first match wins, lower weight is scheduled first, e.g. info-prod-*=50,*-prod*=10")
+	fs.StringVar(&c.TieBreaker, "tie-breaker", c.TieBreaker, "order of candidates with same weight, oldest-first, largest-first or smallest-first")
+	fs.StringVar(&c.ClosedIndices, "closed-indices", c.ClosedIndices, "policy for closed indices, skip, include or fail")
+	fs.StringVar(&c.RedIndices, "red-indices", c.RedIndices, "policy for indices in red health, skip, include or fail")
+	fs.StringVar(&c.Ledger, "ledger", c.Ledger, "name of the configmap recording archive history of indices")
+	fs.DurationVar(&c.RetryBackoff.Duration, "retry-backoff", c.RetryBackoff.Duration, "delay before retrying an index after a failed task, doubled on each consecutive failure")
+	fs.DurationVar(&c.RetryBackoffMax.Duration, "retry-backoff-max", c.RetryBackoffMax.Duration, "maximum delay before retrying an index")
+	fs.IntVar(&c.MaxAttempts, "max-attempts", c.MaxAttempts, "consecutive failed tasks before an index is quarantined, 0 for unlimited")
+	fs.Var((*commaList)(&c.ForceReindex), "force-reindex", "archive indices again even if already archived, patterns comma separated, e.g. access-prod-2021-01-*")
+	fs.BoolVar(&c.DeleteAfterArchive, "delete-after-archive", c.DeleteAfterArchive, "delete index after its task completed and docs count reported by task matches the index")
+	fs.BoolVar(&c.CloseInstead, "close-instead", c.CloseInstead, "close index instead of deleting it with --delete-after-archive")
+	fs.StringVar(&c.ConfigMap, "config-map", c.ConfigMap, "name of the configmap to feed esbridge")
+	fs.StringVar(&c.StorageClass, "storage-class", c.StorageClass, "storage class of pvc")
+	fs.StringVar(&c.StorageRequest, "storage-request", c.StorageRequest, "storage request for pvc, used when storage factor is 0")
+	fs.Float64Var(&c.StorageFactor, "storage-factor", c.StorageFactor, "pvc size as multiple of primary store size of index, 0 for fixed storage request")
+	fs.StringVar(&c.StorageMin, "storage-min", c.StorageMin, "minimum pvc size with storage factor")
+	fs.StringVar(&c.StorageMax, "storage-max", c.StorageMax, "maximum pvc size with storage factor")
+	fs.StringVar(&c.DataMount, "data-mount", c.DataMount, "data directory mount for job")
+	fs.StringVar(&c.ConfigMapKey, "config-map-key", c.ConfigMapKey, "key in config map")
+	fs.StringVar(&c.NotifyURL, "notify-url", c.NotifyURL, "notification url, receiving {\"text\": \"...\"}, more backends in config file")
+	fs.IntVar(&c.NotifyRetries, "notify-retries", c.NotifyRetries, "retries of a failed notification")
+	fs.IntVar(&c.NotifyLogLines, "notify-log-lines", c.NotifyLogLines, "lines of pod logs tail in notifications")
+	fs.IntVar(&c.FailedLogLines, "failed-log-lines", c.FailedLogLines, "lines of pod logs tail collected from a failed task")
+	fs.DurationVar(&c.KeepFailed.Duration, "keep-failed", c.KeepFailed.Duration, "keep failed jobs and their pvc for inspection, e.g. 6h, 0 deletes them right away")
+	fs.StringVar(&c.Batch, "batch", c.Batch, "batch size")
+	fs.Var((*commaList)(&c.Ignores), "ignores", "ignore indices, comma separated")
+	fs.Var((*envVars)(&c.Env), "env", "extra env of task container as KEY=VALUE, repeatable, value is a template like {{.Index}} or {{.Date.Format \"2006.01.02\"}}")
+	fs.Var((*appendList)(&c.EnvFromSecrets), "env-from-secret", "secrets exposed as env of task container, comma separated, repeatable")
+	fs.Var((*appendList)(&c.EnvFromConfigMaps), "env-from-configmap", "configmaps exposed as env of task container, comma separated, repeatable")
+	fs.BoolVar(&c.Loop, "loop", c.Loop, "run as controller, reconcile on task events instead of single pass")
+	fs.DurationVar(&c.Resync.Duration, "resync", c.Resync.Duration, "resync interval in controller mode")
+	fs.StringVar(&c.MetricsAddr, "metrics-addr", c.MetricsAddr, "address to serve /metrics in controller mode, e.g. :9090")
+	fs.StringVar(&c.MetricsPush, "metrics-push", c.MetricsPush, "pushgateway url to push metrics to after a single pass")
+	fs.StringVar(&c.MetricsTextfile, "metrics-textfile", c.MetricsTextfile, "file to write metrics to after a single pass, for node exporter textfile collector")
+	fs.StringVar(&c.PodTemplateFile, "pod-template", c.PodTemplateFile, "yaml file of partial pod template spec merged onto task pods, e.g. nodeSelector, tolerations, securityContext")
+	fs.StringVar(&c.LogFormat, "log-format", c.LogFormat, "log format, text or json")
+}
+
+// LoadConfig loads config for a command from --config file, environment variables and args,
+// extra registers command specific flags, it may be invoked more than once
+func LoadConfig(name string, args []string, extra func(fs *flag.FlagSet)) (cfg *Config, err error) {
+	var optConfig string
+
+	newFlagSet := func(cfg *Config) *flag.FlagSet {
+		fs := flag.NewFlagSet(name, flag.ExitOnError)
+		fs.StringVar(&optConfig, "config", os.Getenv(envPrefix+"CONFIG"), "config file in yaml")
+		cfg.register(fs)
+		if extra != nil {
+			extra(fs)
+		}
+		return fs
+	}
+
+	// first pass, find the config file
+	if err = newFlagSet(DefaultConfig()).Parse(args); err != nil {
+		return
+	}
+
+	cfg = DefaultConfig()
+	if optConfig != "" {
+		if err = LoadConfigFile(optConfig, cfg); err != nil {
+			return
+		}
+	}
+
+	// second pass, environment variables and flags override config file
+	fs := newFlagSet(cfg)
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || f.Name == "config" {
+			return
+		}
+		if val, ok := os.LookupEnv(envNameOfFlag(f.Name)); ok {
+			if err = fs.Set(f.Name, val); err != nil {
+				err = fmt.Errorf("invalid environment variable %s: %s", envNameOfFlag(f.Name), err.Error())
+			}
+		}
+	})
+	if err != nil {
+		return
+	}
+	if err = fs.Parse(args); err != nil {
+		return
+	}
+
+	if cfg.PodTemplateFile != "" {
+		if cfg.filePodTemplate, err = loadPodTemplateFile(cfg.PodTemplateFile); err != nil {
+			err = fmt.Errorf("invalid pod template file %s: %s", cfg.PodTemplateFile, err.Error())
+			return
+		}
+	}
+
+	if err = cfg.Validate(); err != nil {
+		return
+	}
+
+	logger = NewLogger(os.Stderr, cfg.LogFormat)
+	return
+}
+
+func envNameOfFlag(name string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
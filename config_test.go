@@ -0,0 +1,105 @@
+package main
+
+import (
+	"io/ioutil"
+	corev1 "k8s.io/api/core/v1"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeTestConfig(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "esbridgectl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = os.RemoveAll(dir)
+	})
+	file := filepath.Join(dir, "config.yml")
+	if err = ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestLoadConfigPrecedence(t *testing.T) {
+	file := writeTestConfig(t, `
+namespace: from-file
+tasks: 8
+days: 30
+ignores: [a, b]
+resources:
+  limits:
+    memory: 8Gi
+podAnnotations: {}
+`)
+
+	_ = os.Setenv("ESBRIDGECTL_TASKS", "6")
+	_ = os.Setenv("ESBRIDGECTL_DAYS", "40")
+	defer os.Unsetenv("ESBRIDGECTL_TASKS")
+	defer os.Unsetenv("ESBRIDGECTL_DAYS")
+
+	cfg, err := LoadConfig("test", []string{"--config", file, "--days", "50"}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Namespace != "from-file" {
+		t.Errorf("namespace = %s, want from-file", cfg.Namespace)
+	}
+	if cfg.Tasks != 6 {
+		t.Errorf("tasks = %d, want 6 from env", cfg.Tasks)
+	}
+	if cfg.Days != 50 {
+		t.Errorf("days = %d, want 50 from flag", cfg.Days)
+	}
+	if strings.Join(cfg.Ignores, ",") != "a,b" {
+		t.Errorf("ignores = %v", cfg.Ignores)
+	}
+	if mem := cfg.Resources.Limits.Memory().String(); mem != "8Gi" {
+		t.Errorf("memory limit = %s, want 8Gi", mem)
+	}
+	// limits in file replace default limits, default requests are kept
+	if _, ok := cfg.Resources.Limits[corev1.ResourceCPU]; ok {
+		t.Errorf("limits = %v, want no default cpu limit", cfg.Resources.Limits)
+	}
+	if cpu := cfg.Resources.Requests.Cpu().String(); cpu != "2" {
+		t.Errorf("cpu request = %s, want default 2", cpu)
+	}
+	if cfg.Image != "guoyk/esbridge" {
+		t.Errorf("image = %s, want default", cfg.Image)
+	}
+
+	r := NewReconciler(cfg.Options, nil, nil)
+	if job, _ := r.buildJob(Candidate{Index: "a-2021-01-01"}); len(job.Spec.Template.Annotations) != 1 {
+		t.Errorf("pod annotations = %v, want only index annotation", job.Spec.Template.Annotations)
+	}
+}
+
+func TestLoadConfigInvalid(t *testing.T) {
+	if _, err := LoadConfig("test", []string{"--config", writeTestConfig(t, "unknown: 1\n")}, nil); err == nil {
+		t.Error("expected error for unknown field")
+	}
+	_, err := LoadConfig("test", []string{"--config", writeTestConfig(t, "imagePullPolicy: Sometimes\nstorageRequest: lots\n")}, nil)
+	if err == nil || !strings.Contains(err.Error(), "imagePullPolicy") || !strings.Contains(err.Error(), "storageRequest") {
+		t.Errorf("expected validation errors, got %v", err)
+	}
+	// requests of a profile are checked against the limits it inherits
+	_, err = LoadConfig("test", []string{"--config", writeTestConfig(t, `resources:
+  limits:
+    memory: 6000Mi
+profiles:
+  - name: large
+    resources:
+      requests:
+        memory: 8Gi
+  - name: small
+    resources:
+      requests:
+        memory: 1Gi
+`)}, nil)
+	if err == nil || err.Error() != "profiles: large: request of memory exceeds limit" {
+		t.Errorf("expected profile validation error, got %v", err)
+	}
+}
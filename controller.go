@@ -0,0 +1,237 @@
+package main
+
+import (
+	"context"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"time"
+)
+
+const (
+	controllerSettle   = time.Second * 3
+	controllerRewatch  = time.Second * 5
+	controllerDebounce = time.Second * 30
+)
+
+// listFunc lists objects and returns resource version of the list
+type listFunc func(ctx context.Context, opts metav1.ListOptions) (string, error)
+
+type watchFunc func(ctx context.Context, opts metav1.ListOptions) (watch.Interface, error)
+
+// runController keeps reconciling until ctx is done, triggered by task events or the resync interval
+//
+// client-go informers (tools/cache) are not vendored, the controller only needs a trigger and no cache,
+// so taskWatcher lists once and resumes watches from the last seen resource version instead
+func runController(ctx context.Context, r *Reconciler, resync time.Duration) error {
+	klient, namespace := r.Kube, r.Options.Namespace
+
+	c := &controller{
+		reconcile: func(ctx context.Context) (err error) {
+			_, err = r.Reconcile(ctx)
+			return
+		},
+		resync:   resync,
+		settle:   controllerSettle,
+		debounce: controllerDebounce,
+		trigger:  make(chan struct{}, 1),
+	}
+
+	watchers := []*taskWatcher{
+		{
+			kind: "Job",
+			list: func(ctx context.Context, opts metav1.ListOptions) (string, error) {
+				list, err := klient.BatchV1().Jobs(namespace).List(ctx, opts)
+				if err != nil {
+					return "", err
+				}
+				return list.ResourceVersion, nil
+			},
+			watch: klient.BatchV1().Jobs(namespace).Watch,
+		},
+		{
+			kind: "PVC",
+			list: func(ctx context.Context, opts metav1.ListOptions) (string, error) {
+				list, err := klient.CoreV1().PersistentVolumeClaims(namespace).List(ctx, opts)
+				if err != nil {
+					return "", err
+				}
+				return list.ResourceVersion, nil
+			},
+			watch: klient.CoreV1().PersistentVolumeClaims(namespace).Watch,
+		},
+		{
+			kind: "Pod",
+			list: func(ctx context.Context, opts metav1.ListOptions) (string, error) {
+				list, err := klient.CoreV1().Pods(namespace).List(ctx, opts)
+				if err != nil {
+					return "", err
+				}
+				return list.ResourceVersion, nil
+			},
+			watch: klient.CoreV1().Pods(namespace).Watch,
+		},
+	}
+	for _, w := range watchers {
+		w.rewatch = controllerRewatch
+		go w.run(ctx, c.kick)
+	}
+
+	c.kick()
+	c.run(ctx)
+	return nil
+}
+
+// controller runs reconcile on triggers and every resync interval, triggers are coalesced
+type controller struct {
+	reconcile func(ctx context.Context) error
+	resync    time.Duration
+	// settle is the delay after a trigger, letting related events (job, pod, pvc) settle before acting
+	settle time.Duration
+	// debounce is the minimal interval between triggered passes
+	debounce time.Duration
+	trigger  chan struct{}
+}
+
+func (c *controller) kick() {
+	select {
+	case c.trigger <- struct{}{}:
+	default:
+	}
+}
+
+func (c *controller) run(ctx context.Context) {
+	ticker := time.NewTicker(c.resync)
+	defer ticker.Stop()
+
+	var last time.Time
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			logger.Info("Resync")
+		case <-c.trigger:
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(c.settle):
+			}
+			// reconcile itself creates and deletes tasks, avoid reacting to our own changes in a tight loop
+			if wait := c.debounce - time.Since(last); wait > 0 {
+				select {
+				case <-ctx.Done():
+					return
+				case <-time.After(wait):
+				}
+			}
+		}
+
+		// drain pending trigger, this pass covers it
+		select {
+		case <-c.trigger:
+		default:
+		}
+
+		last = time.Now()
+		if err := c.reconcile(ctx); err != nil {
+			logger.WithError(err).Error("Reconcile failed")
+		}
+	}
+}
+
+// taskWatcher watches managed objects of a kind and calls kick on events that may free a slot or need cleanup,
+// watches resume from the last seen resource version, so existing objects are not replayed as added
+type taskWatcher struct {
+	kind    string
+	list    listFunc
+	watch   watchFunc
+	rewatch time.Duration
+}
+
+func (w *taskWatcher) run(ctx context.Context, kick func()) {
+	log := logger.With(Fields{"kind": w.kind})
+
+	var resourceVersion string
+	for {
+		if resourceVersion == "" {
+			var err error
+			if resourceVersion, err = w.list(ctx, metav1.ListOptions{LabelSelector: taskSelector}); err != nil {
+				log.WithError(err).Warn("List failed")
+			} else {
+				// changes while not watching are unknown
+				kick()
+			}
+		}
+
+		if resourceVersion != "" {
+			resourceVersion = w.watchFrom(ctx, resourceVersion, kick, log)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(w.rewatch):
+		}
+	}
+}
+
+// watchFrom watches from resourceVersion until the watch ends, returns the version to resume from, empty to list again
+func (w *taskWatcher) watchFrom(ctx context.Context, resourceVersion string, kick func(), log *Logger) string {
+	wi, err := w.watch(ctx, metav1.ListOptions{
+		LabelSelector:       taskSelector,
+		ResourceVersion:     resourceVersion,
+		AllowWatchBookmarks: true,
+	})
+	if err != nil {
+		log.WithError(err).Warn("Watch failed")
+		return ""
+	}
+	defer wi.Stop()
+
+	for event := range wi.ResultChan() {
+		if event.Type == watch.Error {
+			// mostly 410 gone, the version is too old to resume from
+			log.WithError(apierrors.FromObject(event.Object)).Warn("Watch expired")
+			return ""
+		}
+		if obj, err := meta.Accessor(event.Object); err == nil {
+			resourceVersion = obj.GetResourceVersion()
+		}
+		if event.Type != watch.Bookmark && shouldReconcile(event) {
+			kick()
+		}
+	}
+	return resourceVersion
+}
+
+// shouldReconcile reports whether a watch event changes anything reconcile acts on
+func shouldReconcile(event watch.Event) bool {
+	switch obj := event.Object.(type) {
+	case *batchv1.Job:
+		return event.Type == watch.Deleted || jobFinished(obj)
+	case *corev1.Pod:
+		return obj.Status.Phase == corev1.PodSucceeded || obj.Status.Phase == corev1.PodFailed
+	case *corev1.PersistentVolumeClaim:
+		return event.Type == watch.Deleted
+	}
+	return false
+}
+
+func jobFinished(job *batchv1.Job) bool {
+	return jobHasCondition(job, batchv1.JobComplete) || jobHasCondition(job, batchv1.JobFailed)
+}
+
+// jobHasCondition reports whether condition of type is true on job
+func jobHasCondition(job *batchv1.Job, typ batchv1.JobConditionType) bool {
+	for _, cond := range job.Status.Conditions {
+		if cond.Type == typ && cond.Status == corev1.ConditionTrue {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"errors"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/watch"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestShouldReconcile(t *testing.T) {
+	pod := func(phase corev1.PodPhase) *corev1.Pod {
+		return &corev1.Pod{Status: corev1.PodStatus{Phase: phase}}
+	}
+	for _, c := range []struct {
+		event watch.Event
+		want  bool
+	}{
+		{watch.Event{Type: watch.Added, Object: ongoingJob("a", "", "")}, false},
+		{watch.Event{Type: watch.Modified, Object: finishedJob("a", batchv1.JobComplete)}, true},
+		{watch.Event{Type: watch.Modified, Object: finishedJob("a", batchv1.JobFailed)}, true},
+		{watch.Event{Type: watch.Deleted, Object: ongoingJob("a", "", "")}, true},
+		{watch.Event{Type: watch.Modified, Object: pod(corev1.PodRunning)}, false},
+		{watch.Event{Type: watch.Modified, Object: pod(corev1.PodSucceeded)}, true},
+		{watch.Event{Type: watch.Modified, Object: pod(corev1.PodFailed)}, true},
+		{watch.Event{Type: watch.Added, Object: &corev1.PersistentVolumeClaim{}}, false},
+		{watch.Event{Type: watch.Deleted, Object: &corev1.PersistentVolumeClaim{}}, true},
+		{watch.Event{Type: watch.Deleted, Object: &corev1.ConfigMap{}}, false},
+	} {
+		if got := shouldReconcile(c.event); got != c.want {
+			t.Errorf("shouldReconcile(%s %T) = %t, want %t", c.event.Type, c.event.Object, got, c.want)
+		}
+	}
+}
+
+func TestTaskWatcherResumes(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		lists    int
+		versions []string
+		watchers = make(chan *watch.FakeWatcher, 3)
+	)
+	w := &taskWatcher{
+		kind: "Job",
+		list: func(ctx context.Context, opts metav1.ListOptions) (string, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			lists++
+			return "10", nil
+		},
+		watch: func(ctx context.Context, opts metav1.ListOptions) (watch.Interface, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			versions = append(versions, opts.ResourceVersion)
+			fw := watch.NewFake()
+			watchers <- fw
+			return fw, nil
+		},
+		rewatch: time.Millisecond,
+	}
+	kicks := make(chan struct{}, 10)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go w.run(ctx, func() { kicks <- struct{}{} })
+
+	expectKick := func(want bool) {
+		t.Helper()
+		select {
+		case <-kicks:
+			if !want {
+				t.Fatal("unexpected kick")
+			}
+		case <-time.After(time.Millisecond * 50):
+			if want {
+				t.Fatal("expected kick")
+			}
+		}
+	}
+
+	// listing kicks, then watch events kick only if reconcile acts on them
+	expectKick(true)
+	fw := <-watchers
+	job := ongoingJob("a", "", "")
+	job.ResourceVersion = "11"
+	fw.Add(job)
+	expectKick(false)
+	job = finishedJob("a", batchv1.JobComplete)
+	job.ResourceVersion = "12"
+	fw.Modify(job)
+	expectKick(true)
+
+	// a closed watch resumes from the last version without listing
+	fw.Stop()
+	fw = <-watchers
+	// an error relists
+	fw.Error(&metav1.Status{Status: metav1.StatusFailure, Code: 410, Reason: metav1.StatusReasonExpired})
+	expectKick(true)
+	<-watchers
+	cancel()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if want := []string{"10", "12", "10"}; lists != 2 || !reflect.DeepEqual(versions, want) {
+		t.Fatalf("lists = %d, versions = %v, want 2 and %v", lists, versions, want)
+	}
+}
+
+func TestControllerCoalescesTriggers(t *testing.T) {
+	var (
+		mu    sync.Mutex
+		times []time.Time
+	)
+	c := &controller{
+		reconcile: func(ctx context.Context) error {
+			mu.Lock()
+			defer mu.Unlock()
+			times = append(times, time.Now())
+			return errors.New("failed passes are retried on next trigger")
+		},
+		resync:   time.Hour,
+		settle:   time.Millisecond * 20,
+		debounce: time.Millisecond * 200,
+		trigger:  make(chan struct{}, 1),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		c.run(ctx)
+		close(done)
+	}()
+
+	start := time.Now()
+	// a burst of events is a single pass after settle
+	for i := 0; i < 5; i++ {
+		c.kick()
+	}
+	time.Sleep(time.Millisecond * 100)
+	c.kick()
+	time.Sleep(time.Millisecond * 300)
+	cancel()
+	<-done
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(times) != 2 {
+		t.Fatalf("passes = %d, want 2", len(times))
+	}
+	if d := times[0].Sub(start); d < c.settle {
+		t.Errorf("first pass after %s, want after settle", d)
+	}
+	if d := times[1].Sub(times[0]); d < c.debounce {
+		t.Errorf("second pass %s after first, want debounced", d)
+	}
+}
+
+func TestControllerResyncs(t *testing.T) {
+	passes := make(chan struct{}, 10)
+	c := &controller{
+		reconcile: func(ctx context.Context) error {
+			passes <- struct{}{}
+			return nil
+		},
+		resync:   time.Millisecond * 10,
+		settle:   time.Hour,
+		debounce: time.Hour,
+		trigger:  make(chan struct{}, 1),
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go c.run(ctx)
+	for i := 0; i < 2; i++ {
+		select {
+		case <-passes:
+		case <-time.After(time.Second):
+			t.Fatal("expected resync pass")
+		}
+	}
+}
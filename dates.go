@@ -0,0 +1,230 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Granularity string
+
+const (
+	GranularityHour  Granularity = "hour"
+	GranularityDay   Granularity = "day"
+	GranularityWeek  Granularity = "week"
+	GranularityMonth Granularity = "month"
+)
+
+// DatePattern extracts the period covered by an index from its name
+type DatePattern struct {
+	Name string `json:"name"`
+	// Regexp with named groups year, month, day, hour, or year and week for iso weeks,
+	// if empty, the builtin pattern with the same name is used
+	Regexp      string      `json:"regexp,omitempty"`
+	Granularity Granularity `json:"granularity,omitempty"`
+}
+
+var builtinDatePatterns = map[string]DatePattern{
+	"daily": {
+		Name:        "daily",
+		Regexp:      `(?P<year>\d{4})[._-]?(?P<month>\d{2})[._-]?(?P<day>\d{2})$`,
+		Granularity: GranularityDay,
+	},
+	"hourly": {
+		Name:        "hourly",
+		Regexp:      `(?P<year>\d{4})[._-]?(?P<month>\d{2})[._-]?(?P<day>\d{2})[._-]?(?P<hour>\d{2})$`,
+		Granularity: GranularityHour,
+	},
+	"weekly": {
+		Name:        "weekly",
+		Regexp:      `(?P<year>\d{4})[._-]?[wW](?P<week>\d{2})$`,
+		Granularity: GranularityWeek,
+	},
+	"monthly": {
+		Name:        "monthly",
+		Regexp:      `(?P<year>\d{4})[._-]?(?P<month>\d{2})$`,
+		Granularity: GranularityMonth,
+	},
+}
+
+// indexPeriod is the time range [Start, End) covered by an index
+type indexPeriod struct {
+	Pattern string
+	Start   time.Time
+	End     time.Time
+}
+
+// LastDay returns midnight of the last day in the period
+func (p indexPeriod) LastDay() time.Time {
+	return dateMidnight(p.End.Add(-time.Nanosecond))
+}
+
+type compiledDatePattern struct {
+	DatePattern
+	re *regexp.Regexp
+}
+
+// dateParser extracts periods from index names with the first matching pattern
+type dateParser struct {
+	patterns []compiledDatePattern
+	loc      *time.Location
+}
+
+func newDateParser(patterns []DatePattern, timezone string) (p *dateParser, err error) {
+	p = &dateParser{}
+	if p.loc, err = time.LoadLocation(timezone); err != nil {
+		err = fmt.Errorf("invalid timezone %s: %s", timezone, err.Error())
+		return
+	}
+	for _, dp := range patterns {
+		if dp.Regexp == "" {
+			builtin, ok := builtinDatePatterns[dp.Name]
+			if !ok {
+				err = fmt.Errorf("unknown builtin date pattern: %s", dp.Name)
+				return
+			}
+			dp = builtin
+		}
+		cp := compiledDatePattern{DatePattern: dp}
+		if cp.re, err = regexp.Compile(dp.Regexp); err != nil {
+			err = fmt.Errorf("invalid date pattern %s: %s", dp.Name, err.Error())
+			return
+		}
+		var required []string
+		switch dp.Granularity {
+		case GranularityHour:
+			required = []string{"year", "month", "day", "hour"}
+		case GranularityDay:
+			required = []string{"year", "month", "day"}
+		case GranularityWeek:
+			required = []string{"year", "week"}
+		case GranularityMonth:
+			required = []string{"year", "month"}
+		default:
+			err = fmt.Errorf("invalid date pattern %s: unknown granularity %s", dp.Name, dp.Granularity)
+			return
+		}
+		for _, group := range required {
+			if subexpIndex(cp.re, group) < 0 {
+				err = fmt.Errorf("invalid date pattern %s: missing named group %s", dp.Name, group)
+				return
+			}
+		}
+		p.patterns = append(p.patterns, cp)
+	}
+	return
+}
+
+// Location returns the timezone index dates are interpreted in
+func (p *dateParser) Location() *time.Location {
+	return p.loc
+}
+
+// Parse returns the period of index, ok is false if no pattern matches
+func (p *dateParser) Parse(index string) (period indexPeriod, ok bool) {
+	name := filepath.Base(index)
+	for _, cp := range p.patterns {
+		if period, ok = cp.parse(name, p.loc); ok {
+			return
+		}
+	}
+	return
+}
+
+func (cp compiledDatePattern) parse(name string, loc *time.Location) (period indexPeriod, ok bool) {
+	matches := cp.re.FindStringSubmatch(name)
+	if len(matches) == 0 {
+		return
+	}
+	group := func(key string) int {
+		v, _ := strconv.Atoi(matches[subexpIndex(cp.re, key)])
+		return v
+	}
+
+	year := group("year")
+	period.Pattern = cp.Name
+
+	switch cp.Granularity {
+	case GranularityHour, GranularityDay:
+		month, day, hour := group("month"), group("day"), 0
+		if month < 1 || month > 12 || day < 1 || day > 31 {
+			return
+		}
+		if cp.Granularity == GranularityHour {
+			if hour = group("hour"); hour > 23 {
+				return
+			}
+			period.Start = time.Date(year, time.Month(month), day, hour, 0, 0, 0, loc)
+			period.End = period.Start.Add(time.Hour)
+		} else {
+			period.Start = time.Date(year, time.Month(month), day, 0, 0, 0, 0, loc)
+			period.End = period.Start.AddDate(0, 0, 1)
+		}
+		// reject overflowed dates like 02-31
+		if period.Start.Day() != day {
+			return
+		}
+	case GranularityWeek:
+		week := group("week")
+		if week < 1 || week > 53 {
+			return
+		}
+		// iso week 1 is the week containing january 4th, weeks start on monday
+		jan4 := time.Date(year, time.January, 4, 0, 0, 0, 0, loc)
+		monday := jan4.AddDate(0, 0, -((int(jan4.Weekday()) + 6) % 7))
+		period.Start = monday.AddDate(0, 0, (week-1)*7)
+		period.End = period.Start.AddDate(0, 0, 7)
+		if _, w := period.Start.ISOWeek(); w != week {
+			return
+		}
+	case GranularityMonth:
+		month := group("month")
+		if month < 1 || month > 12 {
+			return
+		}
+		period.Start = time.Date(year, time.Month(month), 1, 0, 0, 0, 0, loc)
+		period.End = period.Start.AddDate(0, 1, 0)
+	default:
+		return
+	}
+
+	ok = true
+	return
+}
+
+func subexpIndex(re *regexp.Regexp, name string) int {
+	for i, n := range re.SubexpNames() {
+		if n == name && i > 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+// datePatternNames is a flag.Value selecting builtin date patterns by comma separated names
+type datePatternNames []DatePattern
+
+func (l *datePatternNames) String() string {
+	var names []string
+	for _, dp := range *l {
+		names = append(names, dp.Name)
+	}
+	return strings.Join(names, ",")
+}
+
+func (l *datePatternNames) Set(s string) error {
+	*l = nil
+	for _, name := range strings.Split(s, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		if _, ok := builtinDatePatterns[name]; !ok {
+			return fmt.Errorf("unknown builtin date pattern: %s", name)
+		}
+		*l = append(*l, DatePattern{Name: name})
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDateParser(t *testing.T) {
+	p, err := newDateParser([]DatePattern{
+		{Name: "daily"},
+		{Name: "hourly"},
+		{Name: "weekly"},
+		{Name: "monthly"},
+		{Name: "month-first", Regexp: `m(?P<month>\d{2})y(?P<year>\d{4})$`, Granularity: GranularityMonth},
+	}, "Asia/Shanghai")
+	if err != nil {
+		t.Fatal(err)
+	}
+	loc := p.Location()
+
+	for index, want := range map[string]struct {
+		pattern string
+		start   time.Time
+		lastDay time.Time
+	}{
+		"access-prod-2021.03.01": {"daily", time.Date(2021, 3, 1, 0, 0, 0, 0, loc), time.Date(2021, 3, 1, 0, 0, 0, 0, loc)},
+		"access-prod-20210301":   {"daily", time.Date(2021, 3, 1, 0, 0, 0, 0, loc), time.Date(2021, 3, 1, 0, 0, 0, 0, loc)},
+		"trace-2021-03-01-14":    {"hourly", time.Date(2021, 3, 1, 14, 0, 0, 0, loc), time.Date(2021, 3, 1, 0, 0, 0, 0, loc)},
+		"logs-2021.w09":          {"weekly", time.Date(2021, 3, 1, 0, 0, 0, 0, loc), time.Date(2021, 3, 7, 0, 0, 0, 0, loc)},
+		"logs-2021-W01":          {"weekly", time.Date(2021, 1, 4, 0, 0, 0, 0, loc), time.Date(2021, 1, 10, 0, 0, 0, 0, loc)},
+		"audit-2021.02":          {"monthly", time.Date(2021, 2, 1, 0, 0, 0, 0, loc), time.Date(2021, 2, 28, 0, 0, 0, 0, loc)},
+		"report-m03y2021":        {"month-first", time.Date(2021, 3, 1, 0, 0, 0, 0, loc), time.Date(2021, 3, 31, 0, 0, 0, 0, loc)},
+	} {
+		period, ok := p.Parse(index)
+		if !ok {
+			t.Errorf("%s: not parsed", index)
+			continue
+		}
+		if period.Pattern != want.pattern || !period.Start.Equal(want.start) || !period.LastDay().Equal(want.lastDay) {
+			t.Errorf("%s: got %s %s %s, want %s %s %s", index, period.Pattern, period.Start, period.LastDay(), want.pattern, want.start, want.lastDay)
+		}
+	}
+
+	for _, index := range []string{"logs-000042", "access-2021-02-30", "access-2021-13-01", "logs-2021.w54"} {
+		if period, ok := p.Parse(index); ok {
+			t.Errorf("%s: unexpected period %+v", index, period)
+		}
+	}
+}
+
+func TestDateParserInvalid(t *testing.T) {
+	for _, patterns := range [][]DatePattern{
+		{{Name: "unknown"}},
+		{{Name: "custom", Regexp: `(?P<year>\d{4})$`, Granularity: GranularityDay}},
+		{{Name: "custom", Regexp: `(?P<year>\d{4})(?P<month>\d{2})$`, Granularity: "decade"}},
+	} {
+		if _, err := newDateParser(patterns, "Local"); err == nil {
+			t.Errorf("expected error for %+v", patterns)
+		}
+	}
+	if _, err := newDateParser(nil, "Mars/Olympus"); err == nil {
+		t.Error("expected error for unknown timezone")
+	}
+}
+
+func TestDaysBetween(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("timezone database not available")
+	}
+	// across daylight saving change on 2021-03-14
+	if days := daysBetween(time.Date(2021, 3, 10, 0, 0, 0, 0, loc), time.Date(2021, 3, 20, 0, 0, 0, 0, loc)); days != 10 {
+		t.Errorf("days = %d, want 10", days)
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"sort"
+	"strings"
+)
+
+// ContainerDiagnostics is the state of a container in the pod of a failed task
+type ContainerDiagnostics struct {
+	Name     string `json:"name"`
+	State    string `json:"state"`
+	Reason   string `json:"reason,omitempty"`
+	Message  string `json:"message,omitempty"`
+	ExitCode int32  `json:"exitCode,omitempty"`
+	Restarts int32  `json:"restarts,omitempty"`
+}
+
+func (c ContainerDiagnostics) String() string {
+	s := c.Name + " " + c.State
+	if c.Reason != "" {
+		s += " " + c.Reason
+	}
+	if c.State == "terminated" {
+		s += fmt.Sprintf(" (exit %d)", c.ExitCode)
+	}
+	if c.Restarts > 0 {
+		s += fmt.Sprintf(", %d restarts", c.Restarts)
+	}
+	return s
+}
+
+// Diagnostics is collected from the pod of a failed task before its job is deleted
+type Diagnostics struct {
+	Pod  string `json:"pod,omitempty"`
+	Node string `json:"node,omitempty"`
+	// Reason and Message of pod, like Evicted
+	Reason     string                 `json:"reason,omitempty"`
+	Message    string                 `json:"message,omitempty"`
+	Containers []ContainerDiagnostics `json:"containers,omitempty"`
+	// Events of job and pod, oldest first
+	Events []string `json:"events,omitempty"`
+	// Logs is the tail of pod logs
+	Logs string `json:"logs,omitempty"`
+}
+
+// Summary returns a one line summary of pod and container failures
+func (d *Diagnostics) Summary() string {
+	var items []string
+	if d.Reason != "" {
+		items = append(items, strings.TrimSuffix(d.Reason+": "+d.Message, ": "))
+	}
+	for _, c := range d.Containers {
+		if c.Reason != "" {
+			items = append(items, c.String())
+		}
+	}
+	return strings.Join(items, "; ")
+}
+
+// ledgerLogLines is the number of log lines kept in the ledger, which is stored in configmaps
+const ledgerLogLines = 5
+
+// ledgerSummary returns a copy of d without events and with trimmed logs
+func (d *Diagnostics) ledgerSummary() *Diagnostics {
+	if d == nil {
+		return nil
+	}
+	out := *d
+	out.Events = nil
+	out.Logs = tailLines(d.Logs, ledgerLogLines)
+	return &out
+}
+
+// containerDiagnostics returns the current state of container, or the last termination if it's waiting to restart
+func containerDiagnostics(status corev1.ContainerStatus) ContainerDiagnostics {
+	c := ContainerDiagnostics{Name: status.Name, Restarts: status.RestartCount}
+	state := status.State
+	if state.Waiting != nil && status.LastTerminationState.Terminated != nil && state.Waiting.Reason == "CrashLoopBackOff" {
+		state = status.LastTerminationState
+	}
+	switch {
+	case state.Terminated != nil:
+		c.State, c.Reason, c.Message, c.ExitCode = "terminated", state.Terminated.Reason, state.Terminated.Message, state.Terminated.ExitCode
+	case state.Waiting != nil:
+		c.State, c.Reason, c.Message = "waiting", state.Waiting.Reason, state.Waiting.Message
+	case state.Running != nil:
+		c.State = "running"
+	}
+	return c
+}
+
+// diagnoseTask collects termination state, events and logs tail of the latest pod of a failed task,
+// errors are logged and leave the diagnostics partial
+func (r *Reconciler) diagnoseTask(ctx context.Context, job batchv1.Job, pods []corev1.Pod) *Diagnostics {
+	d := &Diagnostics{}
+
+	objects := []string{job.Name}
+	pod := taskPod(job, pods, "")
+	if pod != nil {
+		objects = append(objects, pod.Name)
+		d.Pod, d.Node = pod.Name, pod.Spec.NodeName
+		d.Reason, d.Message = pod.Status.Reason, pod.Status.Message
+		for _, status := range append(pod.Status.InitContainerStatuses, pod.Status.ContainerStatuses...) {
+			d.Containers = append(d.Containers, containerDiagnostics(status))
+		}
+	}
+
+	var events []corev1.Event
+	for _, name := range objects {
+		list, err := r.Kube.CoreV1().Events(r.Options.Namespace).List(ctx, metav1.ListOptions{
+			FieldSelector: fields.OneTermEqualSelector("involvedObject.name", name).String(),
+		})
+		if err != nil {
+			r.log().WithError(err).With(Fields{"job": job.Name, "object": name}).Warn("Failed to list events")
+			continue
+		}
+		events = append(events, list.Items...)
+	}
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].LastTimestamp.Before(&events[j].LastTimestamp)
+	})
+	for _, e := range events {
+		d.Events = append(d.Events, fmt.Sprintf("%s %s %s: %s", e.Type, e.InvolvedObject.Kind, e.Reason, e.Message))
+	}
+
+	if pod != nil && r.Options.FailedLogLines > 0 {
+		tailLines := int64(r.Options.FailedLogLines)
+		buf, err := r.Kube.CoreV1().Pods(r.Options.Namespace).GetLogs(pod.Name, &corev1.PodLogOptions{TailLines: &tailLines}).DoRaw(ctx)
+		if err != nil {
+			r.log().WithError(err).With(Fields{"job": job.Name, "pod": pod.Name}).Warn("Failed to get logs")
+		} else {
+			d.Logs = strings.TrimSpace(string(buf))
+		}
+	}
+
+	if summary := d.Summary(); summary != "" {
+		r.log().With(Fields{"job": job.Name, "summary": summary}).Info("Diagnosed")
+	}
+	return d
+}
+
+// tailLines returns the last n lines of s
+func tailLines(s string, n int) string {
+	lines := strings.Split(s, "\n")
+	if n >= 0 && len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return strings.Join(lines, "\n")
+}
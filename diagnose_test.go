@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func failedPod(index string) *corev1.Pod {
+	pod := &corev1.Pod{ObjectMeta: taskObjectMeta(taskNameFromIndex(index)+"-xxxxx", index)}
+	pod.Labels["job-name"] = taskNameFromIndex(index)
+	pod.Spec.NodeName = "node-1"
+	pod.Status.Phase = corev1.PodFailed
+	pod.Status.ContainerStatuses = []corev1.ContainerStatus{{
+		Name:         "task",
+		RestartCount: 2,
+		State:        corev1.ContainerState{Waiting: &corev1.ContainerStateWaiting{Reason: "CrashLoopBackOff"}},
+		LastTerminationState: corev1.ContainerState{Terminated: &corev1.ContainerStateTerminated{
+			Reason:   "OOMKilled",
+			ExitCode: 137,
+		}},
+	}}
+	return pod
+}
+
+func taskEvent(name, kind, object, reason, message string, at time.Time) *corev1.Event {
+	e := &corev1.Event{ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: testNamespace}}
+	e.InvolvedObject = corev1.ObjectReference{Kind: kind, Name: object, Namespace: testNamespace}
+	e.Type, e.Reason, e.Message = corev1.EventTypeWarning, reason, message
+	e.LastTimestamp = metav1.Time{Time: at}
+	return e
+}
+
+func TestReconcilerDiagnosesFailedTask(t *testing.T) {
+	hook := newFakeHook(t, 0)
+
+	opts := testOptions()
+	opts.Tasks = 0
+	opts.NotifyLogLines = 1
+	opts.Notifiers = []NotifierConfig{{Type: NotifierWebhook, URL: hook.URL}}
+	r, kube := newTestReconciler(t, opts, []map[string]string{
+		{"index": "a-2021-01-01"},
+	})
+
+	job := finishedJob("a-2021-01-01", batchv1.JobFailed)
+	job.Status.Conditions[0].Reason = "BackoffLimitExceeded"
+	kube.Add(job)
+	pod := failedPod("a-2021-01-01")
+	kube.Add(pod)
+	kube.SetLog(testNamespace, pod.Name, "line1\nline2\nline3\nline4\nline5\nline6\nfatal: out of memory\n")
+	at := time.Date(2021, 3, 10, 7, 0, 0, 0, time.UTC)
+	kube.Add(taskEvent("e2", "Job", job.Name, "BackoffLimitExceeded", "Job has reached the specified backoff limit", at.Add(time.Minute)))
+	kube.Add(taskEvent("e1", "Pod", pod.Name, "BackOff", "Back-off restarting failed container", at))
+	kube.Add(taskEvent("e3", "Pod", "other", "BackOff", "unrelated", at))
+
+	if _, err := r.Reconcile(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	records, err := r.ledger().Load(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := records["a-2021-01-01"].Diagnostics
+	// the ledger keeps a summary only
+	if d == nil || d.Node != "node-1" || d.Logs != "line3\nline4\nline5\nline6\nfatal: out of memory" || d.Events != nil {
+		t.Fatalf("diagnostics = %+v", d)
+	}
+	if want := []ContainerDiagnostics{{Name: "task", State: "terminated", Reason: "OOMKilled", ExitCode: 137, Restarts: 2}}; !reflect.DeepEqual(d.Containers, want) {
+		t.Fatalf("containers = %+v, want %+v", d.Containers, want)
+	}
+
+	bodies := hook.Bodies()
+	if len(bodies) != 1 {
+		t.Fatalf("bodies = %v", bodies)
+	}
+	e := Event{}
+	if err = json.Unmarshal([]byte(bodies[0]), &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Reason != "BackoffLimitExceeded; task terminated OOMKilled (exit 137), 2 restarts" || e.Logs != "fatal: out of memory" {
+		t.Fatalf("event = %+v", e)
+	}
+	if e.Diagnostics == nil || !strings.HasPrefix(e.Diagnostics.Logs, "line1\n") {
+		t.Fatalf("diagnostics = %+v", e.Diagnostics)
+	}
+	if want := []string{
+		"Warning Pod BackOff: Back-off restarting failed container",
+		"Warning Job BackoffLimitExceeded: Job has reached the specified backoff limit",
+	}; !reflect.DeepEqual(e.Diagnostics.Events, want) {
+		t.Fatalf("events = %v, want %v", e.Diagnostics.Events, want)
+	}
+}
+
+func TestReconcilerKeepsFailedJob(t *testing.T) {
+	hook := newFakeHook(t, 0)
+
+	opts := testOptions()
+	opts.NotifyURL = hook.URL
+	opts.KeepFailed = metav1.Duration{Duration: 6 * time.Hour}
+	opts.RetryBackoff.Duration = 0
+	r, kube := newTestReconciler(t, opts, []map[string]string{
+		{"index": "a-2021-01-01"},
+		{"index": "b-2021-01-01"},
+	})
+	now := r.Now()
+	r.Now = func() time.Time { return now }
+
+	job := finishedJob("a-2021-01-01", batchv1.JobFailed)
+	job.Status.Conditions[0].LastTransitionTime = metav1.Time{Time: now.Add(-time.Hour)}
+	kube.Add(job)
+	kube.Add(&corev1.PersistentVolumeClaim{ObjectMeta: taskObjectMeta(job.Name, "a-2021-01-01")})
+
+	for i := 0; i < 2; i++ {
+		res, err := r.Reconcile(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := []string{job.Name}; !reflect.DeepEqual(res.Kept, want) {
+			t.Fatalf("kept = %v, want %v", res.Kept, want)
+		}
+		// kept job takes no slot, its index is not scheduled
+		if want := []string{"b-2021-01-01"}; i == 0 && !reflect.DeepEqual(res.Scheduled, want) {
+			t.Fatalf("scheduled = %v, want %v", res.Scheduled, want)
+		}
+	}
+	if !kube.Get(&batchv1.Job{}, testNamespace, job.Name) || !kube.Get(&corev1.PersistentVolumeClaim{}, testNamespace, job.Name) {
+		t.Fatal("failed job and its pvc should be kept")
+	}
+
+	now = now.Add(5 * time.Hour)
+	res, err := r.Reconcile(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Kept) != 0 || !reflect.DeepEqual(res.Failed, []string{job.Name}) {
+		t.Fatalf("kept = %v, failed = %v", res.Kept, res.Failed)
+	}
+	// index is retried right away without backoff
+	retried := &batchv1.Job{}
+	if !kube.Get(retried, testNamespace, job.Name) || len(retried.Status.Conditions) != 0 {
+		t.Fatal("failed job should be replaced by a new one after kept")
+	}
+	if bodies := hook.Bodies(); len(bodies) != 1 || !strings.Contains(bodies[0], "任务失败") {
+		t.Fatalf("bodies = %v, want notified once", bodies)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// EnvData is the data env values are rendered with as text/template, e.g. s3://archive/{{.Date.Format "2006/01"}}/{{.Index}}
+type EnvData struct {
+	Index string
+	// Date is the date parsed from index name, or the age of index from other sources
+	Date time.Time
+	// Task is name of job and pvc
+	Task string
+}
+
+// renderEnv renders values of env as templates, variables from valueFrom are kept as is
+func renderEnv(env []corev1.EnvVar, data EnvData) (out []corev1.EnvVar, err error) {
+	for _, e := range env {
+		if e.Value != "" {
+			var tmpl *template.Template
+			if tmpl, err = template.New(e.Name).Option("missingkey=error").Parse(e.Value); err != nil {
+				err = fmt.Errorf("invalid env %s: %s", e.Name, err.Error())
+				return
+			}
+			buf := &bytes.Buffer{}
+			if err = tmpl.Execute(buf, data); err != nil {
+				err = fmt.Errorf("invalid env %s: %s", e.Name, err.Error())
+				return
+			}
+			e.Value = buf.String()
+		}
+		out = append(out, e)
+	}
+	return
+}
+
+// validateEnv checks names of env, and renders values with sample data
+func validateEnv(env []corev1.EnvVar) error {
+	for _, e := range env {
+		if e.Name == "" {
+			return fmt.Errorf("env name is required")
+		}
+	}
+	_, err := renderEnv(env, EnvData{Index: "index-2021-01-01", Date: time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC), Task: "task-index-2021-01-01"})
+	return err
+}
+
+// envVars is a flag.Value of KEY=VALUE, each flag adds or replaces a variable
+type envVars []corev1.EnvVar
+
+func (l *envVars) String() string {
+	var items []string
+	for _, e := range *l {
+		items = append(items, e.Name+"="+e.Value)
+	}
+	return strings.Join(items, ",")
+}
+
+func (l *envVars) Set(s string) error {
+	i := strings.Index(s, "=")
+	if i <= 0 {
+		return fmt.Errorf("invalid env %s, should be KEY=VALUE", s)
+	}
+	e := corev1.EnvVar{Name: s[:i], Value: s[i+1:]}
+	for j := range *l {
+		if (*l)[j].Name == e.Name {
+			(*l)[j] = e
+			return nil
+		}
+	}
+	*l = append(*l, e)
+	return nil
+}
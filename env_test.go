@@ -0,0 +1,77 @@
+package main
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBuildJobEnv(t *testing.T) {
+	file := writeTestConfig(t, `
+env:
+- name: ARCHIVE_TARGET
+  value: s3://archive/default/{{.Index}}
+- name: ACCESS_KEY
+  valueFrom:
+    secretKeyRef: {name: s3, key: access-key}
+profiles:
+- name: prod
+  pattern: "*-prod-*"
+  env:
+  - {name: ARCHIVE_TARGET, value: 's3://archive/{{.Date.Format "2006/01"}}/{{.Index}}'}
+`)
+	cfg, err := LoadConfig("test", []string{
+		"--config", file,
+		"--env", "ESBRIDGE_BATCH_SIZE=100", "--env", "TASK={{.Task}}",
+		"--env-from-secret", "s3-credentials", "--env-from-secret", "s3-extra,s3-credentials", "--env-from-configmap", "archive-settings",
+	}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewReconciler(cfg.Options, nil, nil)
+	date := time.Date(2021, 2, 3, 0, 0, 0, 0, time.UTC)
+	job, err := r.buildJob(Candidate{Index: "access-prod-2021-02-03", Date: date, Profile: "prod"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	container := job.Spec.Template.Spec.Containers[0]
+	var env []string
+	for _, e := range container.Env {
+		env = append(env, e.Name+"="+e.Value)
+	}
+	want := "ESBRIDGE_INDEX=access-prod-2021-02-03,ESBRIDGE_BATCH_SIZE=100,ESBRIDGE_RESULT_CONFIGMAP=task-access-prod-2021-02-03-result," +
+		"ARCHIVE_TARGET=s3://archive/2021/02/access-prod-2021-02-03,ACCESS_KEY=,TASK=task-access-prod-2021-02-03"
+	if strings.Join(env, ",") != want {
+		t.Errorf("env = %v, want %s", env, want)
+	}
+	if ref := container.Env[4].ValueFrom; ref == nil || ref.SecretKeyRef.Name != "s3" {
+		t.Errorf("valueFrom = %+v", ref)
+	}
+	// env-from flags add up like env
+	if from := container.EnvFrom; len(from) != 3 || from[0].SecretRef.Name != "s3-credentials" || from[1].SecretRef.Name != "s3-extra" || from[2].ConfigMapRef.Name != "archive-settings" {
+		t.Errorf("envFrom = %+v", from)
+	}
+
+	job, _ = r.buildJob(Candidate{Index: "debug-2021-02-03", Date: date})
+	if e := job.Spec.Template.Spec.Containers[0].Env[3]; e.Value != "s3://archive/default/debug-2021-02-03" {
+		t.Errorf("env = %+v", e)
+	}
+}
+
+func TestValidateEnv(t *testing.T) {
+	for _, env := range [][]corev1.EnvVar{
+		{{Value: "1"}},
+		{{Name: "A", Value: "{{.Index"}},
+		{{Name: "A", Value: "{{.Indices}}"}},
+	} {
+		if err := validateEnv(env); err == nil {
+			t.Errorf("expected error for %+v", env)
+		}
+	}
+	var l envVars
+	if err := l.Set("NOVALUE"); err == nil {
+		t.Error("expected error for env without value")
+	}
+}
@@ -8,4 +8,5 @@ require (
 	k8s.io/api v0.18.9
 	k8s.io/apimachinery v0.18.9
 	k8s.io/client-go v0.18.9
+	sigs.k8s.io/yaml v1.2.0
 )
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"github.com/olivere/elastic/v7"
+	"strconv"
+	"time"
+)
+
+const (
+	IndexHealthRed    = "red"
+	IndexStatusClosed = "close"
+)
+
+// IndexInfo describes an elasticsearch index
+type IndexInfo struct {
+	Name string `json:"name"`
+	// Health is green, yellow or red, may be empty for closed indices
+	Health string `json:"health"`
+	// Status is open or close
+	Status    string `json:"status"`
+	DocsCount int64  `json:"docsCount"`
+	// StoreSize is bytes of primaries and replicas
+	StoreSize int64 `json:"storeSize"`
+	// PriStoreSize is bytes of primaries
+	PriStoreSize int64 `json:"priStoreSize"`
+	// CreationDate is the creation_date setting of index, zero if unknown
+	CreationDate time.Time `json:"creationDate"`
+}
+
+// IndexStore reads and removes indices in elasticsearch
+type IndexStore interface {
+	ListIndices(ctx context.Context) ([]IndexInfo, error)
+	// NewestTimestamp returns the max value of a date field in index, ok is false if index has no such value
+	NewestTimestamp(ctx context.Context, index string, field string) (t time.Time, ok bool, err error)
+	DeleteIndex(ctx context.Context, index string) error
+	CloseIndex(ctx context.Context, index string) error
+}
+
+type elasticIndexStore struct {
+	client *elastic.Client
+}
+
+// NewElasticIndexStore creates a IndexStore backed by elastic client
+func NewElasticIndexStore(client *elastic.Client) IndexStore {
+	return &elasticIndexStore{client: client}
+}
+
+func (s *elasticIndexStore) ListIndices(ctx context.Context) (out []IndexInfo, err error) {
+	var resp elastic.CatIndicesResponse
+	if resp, err = s.client.CatIndices().
+		Bytes("b").
+		Columns("health", "status", "index", "docs.count", "store.size", "pri.store.size", "creation.date").
+		Do(ctx); err != nil {
+		return
+	}
+	for _, row := range resp {
+		info := IndexInfo{
+			Name:      row.Index,
+			Health:    row.Health,
+			Status:    row.Status,
+			DocsCount: int64(row.DocsCount),
+		}
+		// sizes are empty for closed indices
+		info.StoreSize, _ = strconv.ParseInt(row.StoreSize, 10, 64)
+		info.PriStoreSize, _ = strconv.ParseInt(row.PriStoreSize, 10, 64)
+		if row.CreationDate > 0 {
+			info.CreationDate = time.Unix(0, row.CreationDate*int64(time.Millisecond))
+		}
+		out = append(out, info)
+	}
+	return
+}
+
+func (s *elasticIndexStore) NewestTimestamp(ctx context.Context, index string, field string) (t time.Time, ok bool, err error) {
+	var res *elastic.SearchResult
+	if res, err = s.client.Search(index).
+		Size(0).
+		Aggregation("newest", elastic.NewMaxAggregation().Field(field)).
+		Do(ctx); err != nil {
+		return
+	}
+	agg, found := res.Aggregations.Max("newest")
+	if !found || agg.Value == nil {
+		return
+	}
+	// max of date field is in epoch milliseconds
+	t, ok = time.Unix(0, int64(*agg.Value)*int64(time.Millisecond)), true
+	return
+}
+
+func (s *elasticIndexStore) DeleteIndex(ctx context.Context, index string) (err error) {
+	_, err = s.client.DeleteIndex(index).Do(ctx)
+	return
+}
+
+func (s *elasticIndexStore) CloseIndex(ctx context.Context, index string) (err error) {
+	_, err = s.client.CloseIndex(index).Do(ctx)
+	return
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	IndexPolicySkip    = "skip"
+	IndexPolicyInclude = "include"
+	IndexPolicyFail    = "fail"
+)
+
+const (
+	SkipSystem   = "system"
+	SkipIgnored  = "ignored"
+	SkipClosed   = "closed"
+	SkipRed      = "red"
+	SkipUndated  = "undated"
+	SkipRetained = "retained"
+	SkipArchived = "archived"
+	// SkipSuspicious indices completed with an archive not matching the index, they are kept until forced to reindex
+	SkipSuspicious = "suspicious"
+	// SkipBackoff and SkipQuarantined indices failed recently or too many times
+	SkipBackoff     = "backoff"
+	SkipQuarantined = "quarantined"
+)
+
+// InventoryItem is an index with its computed age and whether it's a candidate
+type InventoryItem struct {
+	IndexInfo
+
+	Date      time.Time     `json:"date,omitempty"`
+	AgeSource string        `json:"ageSource,omitempty"`
+	AgeDays   int           `json:"ageDays"`
+	Retention RetentionRule `json:"retention"`
+	Candidate bool          `json:"candidate"`
+	// Skipped is the reason why the index is not a candidate
+	Skipped string `json:"skipped,omitempty"`
+}
+
+func validateIndexPolicy(policy string) error {
+	switch policy {
+	case IndexPolicySkip, IndexPolicyInclude, IndexPolicyFail:
+		return nil
+	default:
+		return fmt.Errorf("unknown policy %s, should be one of skip, include, fail", policy)
+	}
+}
+
+// applyIndexPolicy returns the skip reason of an unhealthy index, or error if policy is fail
+func applyIndexPolicy(policy string, reason string, info IndexInfo) (skipped string, err error) {
+	switch policy {
+	case IndexPolicyInclude:
+	case IndexPolicyFail:
+		err = fmt.Errorf("index %s is %s", info.Name, reason)
+	default:
+		logger.With(Fields{"index": info.Name, "reason": reason}).Info("Skipped")
+		skipped = reason
+	}
+	return
+}
+
+// Inventory lists all indices sorted by name, with age, retention rule and whether it's a candidate
+func (r *Reconciler) Inventory(ctx context.Context) (items []InventoryItem, err error) {
+	var records map[string]LedgerRecord
+	if records, err = r.ledger().Load(ctx); err != nil {
+		return
+	}
+	return r.inventory(ctx, records)
+}
+
+// inventory lists all indices, indices archived according to ledger records are skipped unless forced
+func (r *Reconciler) inventory(ctx context.Context, records map[string]LedgerRecord) (items []InventoryItem, err error) {
+	var dates *dateParser
+	if dates, err = newDateParser(r.Options.DatePatterns, r.Options.Timezone); err != nil {
+		return
+	}
+
+	now := r.Now().In(dates.Location())
+
+	var retention *retentionPolicy
+	if retention, err = newRetentionPolicy(r.Options.Retention, r.Options.Days); err != nil {
+		return
+	}
+
+	ignores := map[string]bool{}
+	for _, index := range r.Options.Ignores {
+		ignores[index] = true
+	}
+
+	var forced indexMatcher
+	if forced, err = compileIndexPatterns(r.Options.ForceReindex); err != nil {
+		return
+	}
+
+	var indices []IndexInfo
+	if indices, err = r.Indices.ListIndices(ctx); err != nil {
+		return
+	}
+	sort.Slice(indices, func(i, j int) bool {
+		return indices[i].Name < indices[j].Name
+	})
+
+	for _, info := range indices {
+		item := InventoryItem{IndexInfo: info}
+		// forcing is once per run, a task finished since the reconciler started is not forced again
+		force := forced(info.Name) && records[info.Name].FinishedAt.Before(r.StartedAt)
+
+		if strings.HasPrefix(info.Name, ".") {
+			item.Skipped = SkipSystem
+		} else if ignores[info.Name] {
+			r.log().With(Fields{"index": info.Name}).Info("Ignored")
+			item.Skipped = SkipIgnored
+		} else if rec, ok := records[info.Name]; ok && rec.suspicious() && !force {
+			r.log().With(Fields{"index": info.Name, "job": rec.Job, "reason": rec.Reason}).Warn("Archived Suspicious")
+			item.Skipped = SkipSuspicious
+		} else if ok && rec.Archived() && !force {
+			r.log().With(Fields{"index": info.Name, "job": rec.Job, "finished_at": rec.FinishedAt}).Info("Archived")
+			item.Skipped = SkipArchived
+		} else if reason := records[info.Name].waiting(now); reason != "" {
+			r.log().With(Fields{"index": info.Name, "reason": reason}).Info("Skipped")
+			item.Skipped = reason
+		} else if info.Status == IndexStatusClosed {
+			if item.Skipped, err = applyIndexPolicy(r.Options.ClosedIndices, SkipClosed, info); err != nil {
+				return
+			}
+		} else if info.Health == IndexHealthRed {
+			if item.Skipped, err = applyIndexPolicy(r.Options.RedIndices, SkipRed, info); err != nil {
+				return
+			}
+		}
+
+		if item.Skipped == "" {
+			period, source, ok := r.indexAge(ctx, info, dates)
+			if ok {
+				// coarse grained indices are aged by the last day they cover
+				item.Date = period.Start
+				item.AgeSource = source
+				item.AgeDays = daysBetween(period.LastDay(), now)
+				item.Retention = retention.ruleFor(info.Name)
+				if item.AgeDays >= item.Retention.Days {
+					item.Candidate = true
+				} else {
+					item.Skipped = SkipRetained
+				}
+			} else {
+				item.Skipped = SkipUndated
+			}
+		}
+
+		items = append(items, item)
+	}
+	return
+}
+
+// writeInventoryTable writes inventory items as a human readable table
+func writeInventoryTable(w io.Writer, items []InventoryItem) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "INDEX\tHEALTH\tSTATUS\tDOCS\tSIZE\tAGE\tRETENTION\tCANDIDATE")
+	for _, item := range items {
+		age, rule, candidate := "-", "-", "yes"
+		if item.AgeSource != "" {
+			age = strconv.Itoa(item.AgeDays) + "d"
+			rule = item.Retention.String()
+		}
+		if !item.Candidate {
+			candidate = "no (" + item.Skipped + ")"
+		}
+		_, _ = fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\t%s\t%s\t%s\n",
+			item.Name, item.Health, item.Status, item.DocsCount, formatBytes(item.StoreSize), age, rule, candidate)
+	}
+	return tw.Flush()
+}
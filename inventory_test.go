@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestInventory(t *testing.T) {
+	opts := testOptions()
+	opts.Retention = []RetentionRule{{Pattern: "keep-*", Days: 180}}
+	r, _ := newTestReconciler(t, opts, []map[string]string{
+		{"index": "red-2021-01-01", "health": "red", "status": "open"},
+		{"index": "closed-2021-01-01", "status": "close"},
+		{"index": "a-2021-01-01", "health": "green", "status": "open", "docs.count": "42", "store.size": "2048", "pri.store.size": "1024"},
+		{"index": "keep-2021-01-01", "health": "yellow", "status": "open"},
+		{"index": "ignored-2021-01-01"},
+		{"index": "logs-000001"},
+		{"index": ".kibana"},
+	})
+
+	items, err := r.Inventory(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for _, item := range items {
+		if item.Candidate {
+			got[item.Name] = "candidate"
+		} else {
+			got[item.Name] = item.Skipped
+		}
+	}
+	want := map[string]string{
+		".kibana":            SkipSystem,
+		"a-2021-01-01":       "candidate",
+		"closed-2021-01-01":  SkipClosed,
+		"ignored-2021-01-01": SkipIgnored,
+		"keep-2021-01-01":    SkipRetained,
+		"logs-000001":        SkipUndated,
+		"red-2021-01-01":     SkipRed,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("inventory = %v, want %v", got, want)
+	}
+	if a := items[1]; a.Name != "a-2021-01-01" || a.DocsCount != 42 || a.StoreSize != 2048 || a.PriStoreSize != 1024 || a.AgeDays != 68 {
+		t.Fatalf("inventory item = %+v", a)
+	}
+
+	buf := &bytes.Buffer{}
+	if err = writeInventoryTable(buf, items); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "keep-2021-01-01") || !strings.Contains(buf.String(), "no (retained)") {
+		t.Fatalf("table = %s", buf.String())
+	}
+
+	r.Options.RedIndices = IndexPolicyInclude
+	r.Options.ClosedIndices = IndexPolicyInclude
+	candidates, err := r.candidates(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(candidates) != 3 {
+		t.Fatalf("candidates = %v, want red and closed included", candidates)
+	}
+
+	r.Options.RedIndices = IndexPolicyFail
+	if _, err = r.Inventory(context.Background()); err == nil || !strings.Contains(err.Error(), "red-2021-01-01") {
+		t.Fatalf("expected error for red index, got %v", err)
+	}
+}
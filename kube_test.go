@@ -0,0 +1,402 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type fakeKind struct {
+	APIVersion string
+	Kind       string
+}
+
+var fakeKinds = map[string]fakeKind{
+	"jobs":                   {"batch/v1", "Job"},
+	"pods":                   {"v1", "Pod"},
+	"persistentvolumeclaims": {"v1", "PersistentVolumeClaim"},
+	"persistentvolumes":      {"v1", "PersistentVolume"},
+	"configmaps":             {"v1", "ConfigMap"},
+	"events":                 {"v1", "Event"},
+	"secrets":                {"v1", "Secret"},
+}
+
+// fakeKube is a minimal in-memory kubernetes api server, good enough for the typed clientset
+type fakeKube struct {
+	t      *testing.T
+	mu     sync.Mutex
+	rv     int
+	objs   map[string]map[string]interface{}
+	logs   map[string]string
+	stats  map[string]string
+	server *httptest.Server
+
+	// OnCreate is invoked with the stored object after a create, under lock
+	OnCreate func(resource string, obj map[string]interface{})
+	// Reject fails a request with internal error if it returns true, under lock
+	Reject func(method, resource, name string) bool
+
+	Client kubernetes.Interface
+}
+
+func newFakeKube(t *testing.T) *fakeKube {
+	k := &fakeKube{
+		t:     t,
+		objs:  map[string]map[string]interface{}{},
+		logs:  map[string]string{},
+		stats: map[string]string{},
+	}
+	k.server = httptest.NewServer(http.HandlerFunc(k.serve))
+	t.Cleanup(k.server.Close)
+	var err error
+	if k.Client, err = kubernetes.NewForConfig(&rest.Config{Host: k.server.URL, QPS: 1000, Burst: 1000}); err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func fakeKey(resource, namespace, name string) string {
+	return resource + "/" + namespace + "/" + name
+}
+
+func fakeResourceOf(obj runtime.Object) string {
+	switch obj.(type) {
+	case *batchv1.Job:
+		return "jobs"
+	case *corev1.Pod:
+		return "pods"
+	case *corev1.PersistentVolumeClaim:
+		return "persistentvolumeclaims"
+	case *corev1.PersistentVolume:
+		return "persistentvolumes"
+	case *corev1.ConfigMap:
+		return "configmaps"
+	case *corev1.Event:
+		return "events"
+	case *corev1.Secret:
+		return "secrets"
+	}
+	panic(fmt.Sprintf("unsupported object %T", obj))
+}
+
+// Add stores a typed object
+func (k *fakeKube) Add(obj runtime.Object) {
+	resource := fakeResourceOf(obj)
+	buf, err := json.Marshal(obj)
+	if err != nil {
+		k.t.Fatal(err)
+	}
+	m := map[string]interface{}{}
+	_ = json.Unmarshal(buf, &m)
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.store(resource, m)
+}
+
+// Get loads a stored object into out, returns false if not found
+func (k *fakeKube) Get(out runtime.Object, namespace, name string) bool {
+	k.mu.Lock()
+	m, ok := k.objs[fakeKey(fakeResourceOf(out), namespace, name)]
+	k.mu.Unlock()
+	if !ok {
+		return false
+	}
+	buf, _ := json.Marshal(m)
+	if err := json.Unmarshal(buf, out); err != nil {
+		k.t.Fatal(err)
+	}
+	return true
+}
+
+// Names returns sorted names of stored objects of resource
+func (k *fakeKube) Names(resource string) (names []string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	for key := range k.objs {
+		if strings.HasPrefix(key, resource+"/") {
+			names = append(names, key[strings.LastIndex(key, "/")+1:])
+		}
+	}
+	sort.Strings(names)
+	return
+}
+
+// SetStats sets the kubelet stats summary returned for node
+func (k *fakeKube) SetStats(node, summary string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.stats[node] = summary
+}
+
+// SetLog sets the log returned for pod
+func (k *fakeKube) SetLog(namespace, pod, content string) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	k.logs[namespace+"/"+pod] = content
+}
+
+func (k *fakeKube) store(resource string, m map[string]interface{}) {
+	kind := fakeKinds[resource]
+	m["apiVersion"] = kind.APIVersion
+	m["kind"] = kind.Kind
+	meta, _ := m["metadata"].(map[string]interface{})
+	if meta == nil {
+		meta = map[string]interface{}{}
+		m["metadata"] = meta
+	}
+	k.rv++
+	meta["resourceVersion"] = strconv.Itoa(k.rv)
+	if meta["uid"] == nil {
+		meta["uid"] = fmt.Sprintf("uid-%d", k.rv)
+	}
+	if meta["creationTimestamp"] == nil {
+		meta["creationTimestamp"] = "2021-03-01T00:00:00Z"
+	}
+	namespace, _ := meta["namespace"].(string)
+	name, _ := meta["name"].(string)
+	k.objs[fakeKey(resource, namespace, name)] = m
+}
+
+func (k *fakeKube) reply(rw http.ResponseWriter, code int, body interface{}) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(code)
+	_ = json.NewEncoder(rw).Encode(body)
+}
+
+func (k *fakeKube) status(rw http.ResponseWriter, code int, reason, message string) {
+	k.reply(rw, code, map[string]interface{}{
+		"kind":       "Status",
+		"apiVersion": "v1",
+		"status":     "Failure",
+		"reason":     reason,
+		"message":    message,
+		"code":       code,
+	})
+}
+
+func fakeLabelsMatch(m map[string]interface{}, selector string) bool {
+	if selector == "" {
+		return true
+	}
+	meta, _ := m["metadata"].(map[string]interface{})
+	labels, _ := meta["labels"].(map[string]interface{})
+	for _, req := range strings.Split(selector, ",") {
+		kv := strings.SplitN(req, "=", 2)
+		if len(kv) != 2 || labels[kv[0]] != kv[1] {
+			return false
+		}
+	}
+	return true
+}
+
+func fakeFieldsMatch(m map[string]interface{}, selector string) bool {
+	if selector == "" {
+		return true
+	}
+	for _, req := range strings.Split(selector, ",") {
+		kv := strings.SplitN(req, "=", 2)
+		if len(kv) != 2 {
+			return false
+		}
+		var cur interface{} = m
+		for _, field := range strings.Split(kv[0], ".") {
+			obj, _ := cur.(map[string]interface{})
+			cur = obj[field]
+		}
+		if cur != kv[1] {
+			return false
+		}
+	}
+	return true
+}
+
+func fakeMerge(dst, src map[string]interface{}) {
+	for key, val := range src {
+		if val == nil {
+			delete(dst, key)
+			continue
+		}
+		if sub, ok := val.(map[string]interface{}); ok {
+			if dsub, ok := dst[key].(map[string]interface{}); ok {
+				fakeMerge(dsub, sub)
+				continue
+			}
+		}
+		dst[key] = val
+	}
+}
+
+func (k *fakeKube) serve(rw http.ResponseWriter, req *http.Request) {
+	path := req.URL.Path
+	switch {
+	case strings.HasPrefix(path, "/api/v1/"):
+		path = strings.TrimPrefix(path, "/api/v1/")
+	case strings.HasPrefix(path, "/apis/batch/v1/"):
+		path = strings.TrimPrefix(path, "/apis/batch/v1/")
+	default:
+		k.status(rw, http.StatusNotFound, "NotFound", "unknown path "+path)
+		return
+	}
+	segs := strings.Split(path, "/")
+	var namespace, resource, name, sub string
+	if segs[0] == "namespaces" && len(segs) >= 3 {
+		namespace, segs = segs[1], segs[2:]
+	}
+	resource = segs[0]
+	if len(segs) > 1 {
+		name = segs[1]
+	}
+	if len(segs) > 2 {
+		sub = segs[2]
+	}
+	if resource == "nodes" && sub == "proxy" {
+		k.mu.Lock()
+		summary, ok := k.stats[name]
+		k.mu.Unlock()
+		if !ok {
+			k.status(rw, http.StatusServiceUnavailable, "ServiceUnavailable", "no stats for "+name)
+			return
+		}
+		rw.Header().Set("Content-Type", "application/json")
+		_, _ = rw.Write([]byte(summary))
+		return
+	}
+	kind, ok := fakeKinds[resource]
+	if !ok {
+		k.status(rw, http.StatusNotFound, "NotFound", "unknown resource "+resource)
+		return
+	}
+
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	key := fakeKey(resource, namespace, name)
+
+	if k.Reject != nil && k.Reject(req.Method, resource, name) {
+		k.status(rw, http.StatusInternalServerError, "InternalError", "rejected "+req.Method+" "+key)
+		return
+	}
+
+	switch {
+	case sub == "log" && req.Method == http.MethodGet:
+		content, ok := k.logs[namespace+"/"+name]
+		if !ok {
+			k.status(rw, http.StatusNotFound, "NotFound", "no log for "+name)
+			return
+		}
+		if tail, err := strconv.Atoi(req.URL.Query().Get("tailLines")); err == nil {
+			lines := strings.Split(strings.TrimRight(content, "\n"), "\n")
+			if len(lines) > tail {
+				lines = lines[len(lines)-tail:]
+			}
+			content = strings.Join(lines, "\n") + "\n"
+		}
+		rw.Header().Set("Content-Type", "text/plain")
+		_, _ = rw.Write([]byte(content))
+	case name == "" && req.Method == http.MethodGet:
+		if req.URL.Query().Get("watch") != "" {
+			k.status(rw, http.StatusMethodNotAllowed, "MethodNotAllowed", "watch not supported")
+			return
+		}
+		var keys []string
+		for key := range k.objs {
+			if strings.HasPrefix(key, resource+"/"+namespace+"/") {
+				keys = append(keys, key)
+			}
+		}
+		sort.Strings(keys)
+		items := []interface{}{}
+		for _, key := range keys {
+			m := k.objs[key]
+			if fakeLabelsMatch(m, req.URL.Query().Get("labelSelector")) && fakeFieldsMatch(m, req.URL.Query().Get("fieldSelector")) {
+				items = append(items, m)
+			}
+		}
+		k.reply(rw, http.StatusOK, map[string]interface{}{
+			"apiVersion": kind.APIVersion,
+			"kind":       kind.Kind + "List",
+			"metadata":   map[string]interface{}{"resourceVersion": strconv.Itoa(k.rv)},
+			"items":      items,
+		})
+	case name == "" && req.Method == http.MethodPost:
+		m := map[string]interface{}{}
+		buf, _ := ioutil.ReadAll(req.Body)
+		if err := json.Unmarshal(buf, &m); err != nil {
+			k.status(rw, http.StatusBadRequest, "BadRequest", err.Error())
+			return
+		}
+		meta, _ := m["metadata"].(map[string]interface{})
+		name, _ = meta["name"].(string)
+		key = fakeKey(resource, namespace, name)
+		if _, ok := k.objs[key]; ok {
+			k.status(rw, http.StatusConflict, "AlreadyExists", name+" already exists")
+			return
+		}
+		meta["namespace"] = namespace
+		k.store(resource, m)
+		if k.OnCreate != nil {
+			k.OnCreate(resource, m)
+		}
+		k.reply(rw, http.StatusCreated, m)
+	case req.Method == http.MethodGet:
+		m, ok := k.objs[key]
+		if !ok {
+			k.status(rw, http.StatusNotFound, "NotFound", name+" not found")
+			return
+		}
+		k.reply(rw, http.StatusOK, m)
+	case req.Method == http.MethodPut:
+		if _, ok := k.objs[key]; !ok {
+			k.status(rw, http.StatusNotFound, "NotFound", name+" not found")
+			return
+		}
+		m := map[string]interface{}{}
+		buf, _ := ioutil.ReadAll(req.Body)
+		if err := json.Unmarshal(buf, &m); err != nil {
+			k.status(rw, http.StatusBadRequest, "BadRequest", err.Error())
+			return
+		}
+		k.store(resource, m)
+		k.reply(rw, http.StatusOK, m)
+	case req.Method == http.MethodPatch:
+		m, ok := k.objs[key]
+		if !ok {
+			k.status(rw, http.StatusNotFound, "NotFound", name+" not found")
+			return
+		}
+		patch := map[string]interface{}{}
+		buf, _ := ioutil.ReadAll(req.Body)
+		if err := json.Unmarshal(buf, &patch); err != nil {
+			k.status(rw, http.StatusBadRequest, "BadRequest", err.Error())
+			return
+		}
+		fakeMerge(m, patch)
+		k.store(resource, m)
+		k.reply(rw, http.StatusOK, m)
+	case req.Method == http.MethodDelete:
+		if _, ok := k.objs[key]; !ok {
+			k.status(rw, http.StatusNotFound, "NotFound", name+" not found")
+			return
+		}
+		delete(k.objs, key)
+		k.reply(rw, http.StatusOK, map[string]interface{}{
+			"kind":       "Status",
+			"apiVersion": "v1",
+			"status":     "Success",
+		})
+	default:
+		k.status(rw, http.StatusMethodNotAllowed, "MethodNotAllowed", req.Method)
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"k8s.io/client-go/kubernetes"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// LedgerRecord is the archive history of an index, updated on every finished task
+type LedgerRecord struct {
+	Index string `json:"index"`
+	// Outcome of the last task, complete or failed
+	Outcome  string `json:"outcome"`
+	Attempts int    `json:"attempts"`
+	Job      string `json:"job"`
+	// JobUID identifies the task recorded last, a task is recorded once even if its job survives
+	JobUID     types.UID `json:"jobUID"`
+	StartedAt  time.Time `json:"startedAt"`
+	FinishedAt time.Time `json:"finishedAt"`
+	// Size is primary store size of index in bytes
+	Size         int64  `json:"size"`
+	DocsCount    int64  `json:"docsCount,omitempty"`
+	Bytes        int64  `json:"bytes,omitempty"`
+	Checksum     string `json:"checksum,omitempty"`
+	Location     string `json:"location,omitempty"`
+	Verification string `json:"verification,omitempty"`
+	Reason       string `json:"reason,omitempty"`
+	// Failures is consecutive failed tasks, reset by a completed task
+	Failures int `json:"failures,omitempty"`
+	// NextRetryAt is the end of backoff after a failed task
+	NextRetryAt time.Time `json:"nextRetryAt,omitempty"`
+	// Quarantined index is not archived again until retried or unquarantined
+	Quarantined bool `json:"quarantined,omitempty"`
+	// IndexRemoved is true once the archived index is deleted or closed
+	IndexRemoved bool `json:"indexRemoved,omitempty"`
+	// RemoveError is the last failure to remove the index
+	RemoveError string `json:"removeError,omitempty"`
+	// NotifyError is the last failure to notify the outcome
+	NotifyError string `json:"notifyError,omitempty"`
+	// PendingEvent is a failed notification retried by later passes
+	PendingEvent *Event `json:"pendingEvent,omitempty"`
+	// FailedNotifiers are names of notifiers PendingEvent is retried with
+	FailedNotifiers []string `json:"failedNotifiers,omitempty"`
+	// Diagnostics of the last task if it failed, without events and with a short log tail
+	Diagnostics *Diagnostics `json:"diagnostics,omitempty"`
+}
+
+// recorded returns true if job is the task recorded last
+func (rec LedgerRecord) recorded(job batchv1.Job) bool {
+	return rec.JobUID != "" && rec.JobUID == job.UID
+}
+
+// Archived returns true if the last task of index completed
+func (rec LedgerRecord) Archived() bool {
+	return rec.Outcome == OutcomeComplete
+}
+
+// suspicious returns true if the last task of index completed with an archive not matching the index
+func (rec LedgerRecord) suspicious() bool {
+	return rec.Archived() && rec.Verification == VerificationSuspicious
+}
+
+const (
+	// ledgerLabelKey labels configmaps of records with name of the ledger
+	ledgerLabelKey = "ledger.esbridgectl.logtube"
+	// ledgerRecordKey is the configmap key of a record
+	ledgerRecordKey = "record"
+)
+
+var ledgerNameInvalidChars = regexp.MustCompile(`[^-a-z0-9]`)
+
+// ledgerConfigMapName returns a valid configmap name for the record of index
+func ledgerConfigMapName(ledger, index string) string {
+	if name := ledger + "-" + index; len(validation.IsDNS1123Subdomain(name)) == 0 {
+		return name
+	}
+	name := ledgerNameInvalidChars.ReplaceAllString(strings.ToLower(index), "-")
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(index))
+	suffix := fmt.Sprintf("-%08x", h.Sum32())
+	if max := validation.DNS1123SubdomainMaxLength - len(ledger) - 1 - len(suffix); len(name) > max {
+		name = name[:max]
+	}
+	return ledger + "-" + name + suffix
+}
+
+// ledger stores each record as json in its own configmap labeled with the ledger name
+type ledger struct {
+	kube      kubernetes.Interface
+	namespace string
+	name      string
+}
+
+func (r *Reconciler) ledger() *ledger {
+	return &ledger{kube: r.Kube, namespace: r.Options.Namespace, name: r.Options.Ledger}
+}
+
+// Load returns all records by index
+func (l *ledger) Load(ctx context.Context) (records map[string]LedgerRecord, err error) {
+	records = map[string]LedgerRecord{}
+
+	var list *corev1.ConfigMapList
+	if list, err = l.kube.CoreV1().ConfigMaps(l.namespace).List(ctx, metav1.ListOptions{
+		LabelSelector: fields.OneTermEqualSelector(ledgerLabelKey, l.name).String(),
+	}); err != nil {
+		return
+	}
+	for _, cm := range list.Items {
+		var rec LedgerRecord
+		if err = json.Unmarshal([]byte(cm.Data[ledgerRecordKey]), &rec); err != nil {
+			err = fmt.Errorf("invalid ledger record %s: %s", cm.Name, err.Error())
+			return
+		}
+		records[rec.Index] = rec
+	}
+	return
+}
+
+// Put creates or replaces record of an index
+func (l *ledger) Put(ctx context.Context, rec LedgerRecord) (err error) {
+	var buf []byte
+	if buf, err = json.Marshal(rec); err != nil {
+		return
+	}
+	name := ledgerConfigMapName(l.name, rec.Index)
+	var patch []byte
+	if patch, err = json.Marshal(map[string]interface{}{
+		"data": map[string]string{ledgerRecordKey: string(buf)},
+	}); err != nil {
+		return
+	}
+	if _, err = l.kube.CoreV1().ConfigMaps(l.namespace).Patch(ctx, name, types.MergePatchType, patch, metav1.PatchOptions{}); err == nil || !apierrors.IsNotFound(err) {
+		return
+	}
+	cm := &corev1.ConfigMap{}
+	cm.Namespace = l.namespace
+	cm.Name = name
+	cm.Labels = map[string]string{ledgerLabelKey: l.name}
+	cm.Annotations = map[string]string{indexAnnotationKey: rec.Index}
+	cm.Data = map[string]string{ledgerRecordKey: string(buf)}
+	_, err = l.kube.CoreV1().ConfigMaps(l.namespace).Create(ctx, cm, metav1.CreateOptions{})
+	return
+}
+
+// ledgerRecord returns the record of a finished job on top of previous record, ok is false if the job is already recorded
+func ledgerRecord(prev LedgerRecord, job batchv1.Job, outcome string, verification *Verification, event Event) (rec LedgerRecord, ok bool) {
+	if prev.recorded(job) {
+		return
+	}
+	rec = prev
+	rec.Index = job.Annotations[indexAnnotationKey]
+	rec.Outcome = outcome
+	rec.Attempts++
+	rec.Job = job.Name
+	rec.JobUID = job.UID
+	rec.StartedAt, rec.FinishedAt = time.Time{}, jobFinishedAt(job)
+	if job.Status.StartTime != nil {
+		rec.StartedAt = job.Status.StartTime.Time
+	}
+	rec.Size, _ = strconv.ParseInt(job.Annotations[sizeAnnotationKey], 10, 64)
+	rec.DocsCount, rec.Bytes, rec.Checksum, rec.Location, rec.Verification = 0, 0, "", "", ""
+	rec.Reason = event.Reason
+	rec.IndexRemoved, rec.RemoveError = false, ""
+	rec.Diagnostics = event.Diagnostics.ledgerSummary()
+	if verification != nil {
+		rec.Verification = verification.Status
+		if verification.Status == VerificationSuspicious {
+			rec.Reason = verification.Reason
+		}
+		if m := verification.Manifest; m != nil {
+			rec.DocsCount, rec.Bytes, rec.Checksum, rec.Location = m.DocsCount, m.Bytes, m.Checksum, m.Location
+		}
+	}
+	ok = true
+	return
+}
+
+// sortLedgerRecords returns records with the latest finished first
+func sortLedgerRecords(records map[string]LedgerRecord) (out []LedgerRecord) {
+	for _, rec := range records {
+		out = append(out, rec)
+	}
+	sort.Slice(out, func(i, j int) bool {
+		if !out[i].FinishedAt.Equal(out[j].FinishedAt) {
+			return out[i].FinishedAt.After(out[j].FinishedAt)
+		}
+		return out[i].Index < out[j].Index
+	})
+	return
+}
+
+// writeLedgerTable writes records as a human readable table
+func writeLedgerTable(w io.Writer, records []LedgerRecord) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "INDEX\tOUTCOME\tATTEMPTS\tFINISHED\tDURATION\tSIZE\tARCHIVED\tLOCATION")
+	for _, rec := range records {
+		outcome := rec.Outcome
+		if rec.Verification != "" {
+			outcome += "/" + rec.Verification
+		}
+		if rec.Quarantined {
+			outcome += "/quarantined"
+		}
+		if rec.IndexRemoved {
+			outcome += "/removed"
+		} else if rec.RemoveError != "" {
+			outcome += "/remove-failed"
+		}
+		finished, duration := "-", "-"
+		if !rec.FinishedAt.IsZero() {
+			finished = rec.FinishedAt.Format(time.RFC3339)
+		}
+		if !rec.FinishedAt.IsZero() && !rec.StartedAt.IsZero() {
+			duration = rec.FinishedAt.Sub(rec.StartedAt).String()
+		}
+		location := rec.Location
+		if location == "" {
+			location = "-"
+		}
+		_, _ = fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\t%s\t%s\t%s\n",
+			rec.Index, outcome, rec.Attempts, finished, duration, formatBytes(rec.Size), formatBytes(rec.Bytes), location)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	batchv1 "k8s.io/api/batch/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReconcilerRecordsLedger(t *testing.T) {
+	opts := testOptions()
+	opts.Tasks = 0
+	r, kube := newTestReconciler(t, opts, []map[string]string{
+		{"index": "a-2021-01-01", "docs.count": "42", "pri.store.size": "2048"},
+		{"index": "b-2021-01-01"},
+	})
+	a := finishedJob("a-2021-01-01", batchv1.JobComplete)
+	a.Annotations[sizeAnnotationKey] = "2048"
+	kube.Add(a)
+	kube.Add(succeededPod("a-2021-01-01", testManifest))
+	kube.Add(finishedJob("b-2021-01-01", batchv1.JobFailed))
+
+	if _, err := r.Reconcile(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	records, err := r.ledger().Load(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec := records["a-2021-01-01"]; rec.Outcome != OutcomeComplete || rec.Attempts != 1 || rec.Verification != VerificationVerified ||
+		rec.Size != 2048 || rec.DocsCount != 42 || rec.Location != "s3://archive/a" || rec.Job != "task-a-2021-01-01" {
+		t.Fatalf("record of a = %+v", rec)
+	}
+	if rec := records["b-2021-01-01"]; rec.Outcome != OutcomeFailed || rec.Attempts != 1 || rec.Verification != "" {
+		t.Fatalf("record of b = %+v", rec)
+	}
+
+	// a new attempt of b is counted
+	kube.Add(finishedJob("b-2021-01-01", batchv1.JobComplete))
+	kube.Add(resultConfigMap("b-2021-01-01", testManifest))
+	if _, err = r.Reconcile(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	records, _ = r.ledger().Load(context.Background())
+	if rec := records["b-2021-01-01"]; rec.Outcome != OutcomeComplete || rec.Attempts != 2 || rec.Verification != VerificationSuspicious {
+		t.Fatalf("record of b = %+v", rec)
+	}
+	if rec := records["a-2021-01-01"]; rec.Attempts != 1 {
+		t.Fatalf("record of a = %+v", rec)
+	}
+}
+
+func TestReconcilerRecordsSurvivingJobOnce(t *testing.T) {
+	opts := testOptions()
+	opts.Tasks = 0
+	r, kube := newTestReconciler(t, opts, []map[string]string{
+		{"index": "a-2021-01-01"},
+	})
+	kube.Add(finishedJob("a-2021-01-01", batchv1.JobFailed))
+	kube.Reject = func(method, resource, name string) bool {
+		return method == http.MethodDelete && resource == "jobs"
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err := r.Reconcile(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if want := []string{"task-a-2021-01-01"}; !reflect.DeepEqual(kube.Names("jobs"), want) {
+		t.Fatalf("jobs = %v, want %v", kube.Names("jobs"), want)
+	}
+	records, err := r.ledger().Load(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec := records["a-2021-01-01"]; rec.Attempts != 1 {
+		t.Fatalf("record = %+v, want recorded once", rec)
+	}
+}
+
+func TestWriteLedgerTable(t *testing.T) {
+	started := time.Date(2021, 3, 10, 8, 0, 0, 0, time.UTC)
+	records := sortLedgerRecords(map[string]LedgerRecord{
+		"a": {Index: "a", Outcome: OutcomeComplete, Attempts: 1, StartedAt: started, FinishedAt: started.Add(time.Hour), Size: 2 << 30, Bytes: 1 << 30, Verification: VerificationVerified, Location: "s3://archive/a"},
+		"b": {Index: "b", Outcome: OutcomeFailed, Attempts: 3, FinishedAt: started.Add(2 * time.Hour)},
+	})
+	buf := &bytes.Buffer{}
+	if err := writeLedgerTable(buf, records); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("table = %s", buf.String())
+	}
+	if fields := strings.Fields(lines[1]); fields[0] != "b" || fields[2] != "3" || fields[4] != "-" {
+		t.Fatalf("row = %s", lines[1])
+	}
+	if fields := strings.Fields(lines[2]); fields[1] != "complete/verified" || fields[4] != "1h0m0s" || fields[7] != "s3://archive/a" {
+		t.Fatalf("row = %s", lines[2])
+	}
+}
+
+func TestReconcilerSkipsArchivedIndex(t *testing.T) {
+	opts := testOptions()
+	opts.Tasks = 4
+	r, kube := newTestReconciler(t, opts, []map[string]string{
+		{"index": "a-2021-01-01", "docs.count": "42"},
+		{"index": "b-2021-01-01"},
+		{"index": "c-2021-01-01"},
+		{"index": "d-2021-01-01"},
+		{"index": "e-2021-01-01"},
+	})
+	for _, rec := range []LedgerRecord{
+		{Index: "b-2021-01-01", Outcome: OutcomeComplete, Verification: VerificationVerified},
+		{Index: "c-2021-01-01", Outcome: OutcomeComplete, Verification: VerificationSuspicious},
+		{Index: "d-2021-01-01", Outcome: OutcomeFailed},
+		{Index: "e-2021-01-01", Outcome: OutcomeComplete, Verification: VerificationVerified},
+	} {
+		if err := r.ledger().Put(context.Background(), rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a completes in this pass, without deleteAfterArchive it stays in elasticsearch
+	kube.Add(finishedJob("a-2021-01-01", batchv1.JobComplete))
+	kube.Add(succeededPod("a-2021-01-01", testManifest))
+	r.Options.ForceReindex = []string{"e-*"}
+
+	res, err := r.Reconcile(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// suspicious c is reported instead
+	if want := []string{"d-2021-01-01", "e-2021-01-01"}; !reflect.DeepEqual(res.Scheduled, want) {
+		t.Fatalf("scheduled = %v, want %v", res.Scheduled, want)
+	}
+	if want := []string{"c-2021-01-01: "}; !reflect.DeepEqual(res.Suspicious, want) {
+		t.Fatalf("suspicious = %v, want %v", res.Suspicious, want)
+	}
+
+	items, err := r.Inventory(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if items[0].Skipped != SkipArchived || items[1].Skipped != SkipArchived || items[2].Skipped != SkipSuspicious {
+		t.Fatalf("inventory = %+v, want a and b archived, c suspicious", items)
+	}
+
+	// forced suspicious index is archived again
+	r.Options.ForceReindex = []string{"c-*"}
+	if items, err = r.Inventory(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if items[2].Skipped != "" {
+		t.Fatalf("inventory = %+v, want c forced", items)
+	}
+}
+
+func TestReconcilerForcesReindexOnce(t *testing.T) {
+	opts := testOptions()
+	opts.ForceReindex = []string{"a-*"}
+	r, kube := newTestReconciler(t, opts, []map[string]string{
+		{"index": "a-2021-01-01", "docs.count": "42"},
+	})
+	r.StartedAt = r.Now()
+	if err := r.ledger().Put(context.Background(), LedgerRecord{Index: "a-2021-01-01", Outcome: OutcomeComplete, Verification: VerificationVerified}); err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := r.Reconcile(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a-2021-01-01"}; !reflect.DeepEqual(res.Scheduled, want) {
+		t.Fatalf("scheduled = %v, want %v", res.Scheduled, want)
+	}
+
+	// the forced task completes, a is neither rescheduled in the pass recording it nor in later ones
+	job := finishedJob("a-2021-01-01", batchv1.JobComplete)
+	job.Status.CompletionTime = &metav1.Time{Time: r.StartedAt.Add(time.Hour)}
+	kube.Add(job)
+	kube.Add(succeededPod("a-2021-01-01", testManifest))
+	for i := 0; i < 2; i++ {
+		if res, err = r.Reconcile(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		if len(res.Scheduled) != 0 {
+			t.Fatalf("pass %d scheduled = %v, want none", i, res.Scheduled)
+		}
+	}
+
+	// a new run forces it again
+	r.StartedAt = r.StartedAt.Add(2 * time.Hour)
+	if res, err = r.Reconcile(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a-2021-01-01"}; !reflect.DeepEqual(res.Scheduled, want) {
+		t.Fatalf("scheduled = %v, want %v", res.Scheduled, want)
+	}
+}
+
+func TestReconcilerKeepsTaskIfRecordFails(t *testing.T) {
+	opts := testOptions()
+	opts.Tasks = 0
+	r, kube := newTestReconciler(t, opts, []map[string]string{
+		{"index": "a-2021-01-01"},
+		{"index": "b-2021-01-01"},
+		{"index": "c-2021-01-01", "docs.count": "42"},
+	})
+	kube.Add(finishedJob("a-2021-01-01", batchv1.JobFailed))
+	kube.Add(finishedJob("b-2021-01-01", batchv1.JobFailed))
+	kube.Add(finishedJob("c-2021-01-01", batchv1.JobComplete))
+	kube.Add(succeededPod("c-2021-01-01", testManifest))
+	kube.Reject = func(method, resource, name string) bool {
+		return resource == "configmaps" && (name == ledgerConfigMapName(opts.Ledger, "a-2021-01-01") || name == ledgerConfigMapName(opts.Ledger, "c-2021-01-01"))
+	}
+
+	res, err := r.Reconcile(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a-2021-01-01", "c-2021-01-01"}; !reflect.DeepEqual(res.RecordFailures, want) {
+		t.Fatalf("record failures = %v, want %v", res.RecordFailures, want)
+	}
+	// b is cleaned up, a and c are kept until recorded, with the pod holding the manifest of c
+	if want := []string{"task-a-2021-01-01", "task-c-2021-01-01"}; !reflect.DeepEqual(kube.Names("jobs"), want) {
+		t.Fatalf("jobs = %v, want %v", kube.Names("jobs"), want)
+	}
+	if want := []string{"task-c-2021-01-01-xxxxx"}; !reflect.DeepEqual(kube.Names("pods"), want) {
+		t.Fatalf("pods = %v, want %v", kube.Names("pods"), want)
+	}
+
+	kube.Reject = nil
+	if res, err = r.Reconcile(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"c-2021-01-01"}; !reflect.DeepEqual(res.Verified, want) || len(res.Suspicious) != 0 {
+		t.Fatalf("verified = %v, suspicious = %v", res.Verified, res.Suspicious)
+	}
+	records, _ := r.ledger().Load(context.Background())
+	if records["a-2021-01-01"].Attempts != 1 || records["c-2021-01-01"].Verification != VerificationVerified ||
+		len(kube.Names("jobs")) != 0 || len(kube.Names("pods")) != 0 {
+		t.Fatalf("records = %+v, jobs = %v, pods = %v", records, kube.Names("jobs"), kube.Names("pods"))
+	}
+}
+
+func TestLedgerConfigMapName(t *testing.T) {
+	for index, want := range map[string]string{
+		"a-2021.01.01": "ledger-a-2021.01.01",
+		".kibana":      "ledger--kibana-",
+		"A_b":          "ledger-a-b-",
+		"a.":           "ledger-a--",
+	} {
+		if got := ledgerConfigMapName("ledger", index); !strings.HasPrefix(got, want) || (got != want && len(got) != len(want)+8) {
+			t.Errorf("ledgerConfigMapName(%s) = %s, want %s", index, got, want)
+		}
+	}
+	if ledgerConfigMapName("ledger", "a_b") == ledgerConfigMapName("ledger", "a-b") {
+		t.Error("names of a_b and a-b collide")
+	}
+	if got := ledgerConfigMapName("ledger", strings.Repeat("a", 255)); len(got) != 253 {
+		t.Errorf("len = %d, want 253", len(got))
+	}
+}
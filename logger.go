@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	LogFormatText = "text"
+	LogFormatJSON = "json"
+
+	LogLevelInfo  = "info"
+	LogLevelWarn  = "warn"
+	LogLevelError = "error"
+)
+
+// Fields are context of a log entry, like action, index, job, pvc, pv, namespace and dry_run
+type Fields map[string]interface{}
+
+// Logger writes structured log entries as logfmt like text or json lines
+type Logger struct {
+	mu     *sync.Mutex
+	out    io.Writer
+	format string
+	fields Fields
+}
+
+// logger is the process wide logger, replaced by main once config is loaded
+var logger = NewLogger(os.Stderr, LogFormatText)
+
+func NewLogger(out io.Writer, format string) *Logger {
+	return &Logger{mu: &sync.Mutex{}, out: out, format: format}
+}
+
+func validateLogFormat(format string) error {
+	switch format {
+	case LogFormatText, LogFormatJSON:
+		return nil
+	default:
+		return fmt.Errorf("unknown log format %s, should be text or json", format)
+	}
+}
+
+// With returns a logger adding fields to every entry, fields of the same name are replaced
+func (l *Logger) With(fields Fields) *Logger {
+	merged := Fields{}
+	for k, v := range l.fields {
+		merged[k] = v
+	}
+	for k, v := range fields {
+		merged[k] = v
+	}
+	return &Logger{mu: l.mu, out: l.out, format: l.format, fields: merged}
+}
+
+// WithError returns a logger adding error field
+func (l *Logger) WithError(err error) *Logger {
+	return l.With(Fields{"error": err.Error()})
+}
+
+func (l *Logger) Info(msg string)  { l.write(LogLevelInfo, msg) }
+func (l *Logger) Warn(msg string)  { l.write(LogLevelWarn, msg) }
+func (l *Logger) Error(msg string) { l.write(LogLevelError, msg) }
+
+func (l *Logger) write(level, msg string) {
+	now := time.Now().Format(time.RFC3339)
+
+	var keys []string
+	for k := range l.fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	buf := &bytes.Buffer{}
+	if l.format == LogFormatJSON {
+		entry := map[string]interface{}{}
+		for k, v := range l.fields {
+			entry[k] = logValue(v)
+		}
+		entry["time"], entry["level"], entry["msg"] = now, level, msg
+		// map keys are sorted by encoding/json
+		_ = json.NewEncoder(buf).Encode(entry)
+	} else {
+		buf.WriteString(now + " " + strings.ToUpper(level) + " " + msg)
+		for _, k := range keys {
+			buf.WriteString(" " + k + "=" + logText(logValue(l.fields[k])))
+		}
+		buf.WriteByte('\n')
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, _ = l.out.Write(buf.Bytes())
+}
+
+// logValue converts values to their string form if they are not plain json values
+func logValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case nil, bool, string, int, int32, int64, float64:
+		return v
+	case time.Duration:
+		return v.String()
+	case time.Time:
+		return v.Format(time.RFC3339)
+	case []string:
+		return strings.Join(v, ",")
+	case fmt.Stringer:
+		return v.String()
+	case error:
+		return v.Error()
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+// logText formats a value for text format, quoted if empty or containing spaces, quotes or equal signs
+func logText(v interface{}) string {
+	s := fmt.Sprint(v)
+	if s == "" || strings.ContainsAny(s, " \t\n\"=") {
+		return strconv.Quote(s)
+	}
+	return s
+}
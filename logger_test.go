@@ -0,0 +1,51 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoggerText(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := NewLogger(buf, LogFormatText).With(Fields{"index": "a-2021-01-01", "dry_run": false})
+	l.With(Fields{"dry_run": true, "reason": "no space left"}).WithError(errors.New("failed")).Warn("Action")
+	l.Info("Saw Ongoing")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("lines = %q", lines)
+	}
+	if _, err := time.Parse(time.RFC3339, strings.Fields(lines[0])[0]); err != nil {
+		t.Fatal(err)
+	}
+	if want := ` WARN Action dry_run=true error=failed index=a-2021-01-01 reason="no space left"`; !strings.HasSuffix(lines[0], want) {
+		t.Fatalf("line = %s, want suffix %s", lines[0], want)
+	}
+	// fields of derived loggers never leak into parent
+	if want := ` INFO Saw Ongoing dry_run=false index=a-2021-01-01`; !strings.HasSuffix(lines[1], want) {
+		t.Fatalf("line = %s, want suffix %s", lines[1], want)
+	}
+}
+
+func TestLoggerJSON(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := NewLogger(buf, LogFormatJSON)
+	l.With(Fields{"job": "task-a", "slots": 2, "until": time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)}).Error("Keep Failed")
+
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Fatal(err)
+	}
+	if entry["level"] != LogLevelError || entry["msg"] != "Keep Failed" || entry["job"] != "task-a" ||
+		entry["slots"] != float64(2) || entry["until"] != "2021-03-01T00:00:00Z" || entry["time"] == nil {
+		t.Fatalf("entry = %v", entry)
+	}
+
+	if err := validateLogFormat("xml"); err == nil {
+		t.Fatal("expected error")
+	}
+}
@@ -2,23 +2,23 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"github.com/olivere/elastic/v7"
-	"go.guoyk.net/requo"
-	batchv1 "k8s.io/api/batch/v1"
+	"io/ioutil"
 	corev1 "k8s.io/api/core/v1"
-	"k8s.io/apimachinery/pkg/api/errors"
-	"k8s.io/apimachinery/pkg/api/resource"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/types"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
-	"log"
 	"math/rand"
+	"net/http"
 	"os"
+	"os/signal"
+	"sigs.k8s.io/yaml"
 	"strings"
+	"syscall"
 	"time"
 )
 
@@ -31,6 +31,12 @@ const (
 	taskLabelValue     = "esbridgectl"
 	taskPrefix         = "task-"
 	indexAnnotationKey = "index.esbridgectl.logtube"
+
+	retentionAnnotationKey = "retention.esbridgectl.logtube"
+	storageAnnotationKey   = "storage.esbridgectl.logtube"
+	sizeAnnotationKey      = "size.esbridgectl.logtube"
+	notifiedAnnotationKey  = "notified.esbridgectl.logtube"
+	profileAnnotationKey   = "profile.esbridgectl.logtube"
 )
 
 const PatchRetain = `{"spec":{"persistentVolumeReclaimPolicy":"` + corev1.PersistentVolumeReclaimRetain + `"}}`
@@ -39,355 +45,471 @@ var (
 	taskSelector = fmt.Sprintf("%s=%s", taskLabelKey, taskLabelValue)
 )
 
+// newKubeClient creates kubernetes client from config
+func newKubeClient(cfg *Config) (klient *kubernetes.Clientset, err error) {
+	var config *rest.Config
+	if config, err = clientcmd.BuildConfigFromFlags("", cfg.Kubeconfig); err != nil {
+		return
+	}
+	klient, err = kubernetes.NewForConfig(config)
+	return
+}
+
+// newReconciler creates clients and a Reconciler from config
+func newReconciler(cfg *Config) (r *Reconciler, err error) {
+	var client *elastic.Client
+	if client, err = elastic.NewClient(elastic.SetURL(cfg.ESURL), elastic.SetSniff(false)); err != nil {
+		return
+	}
+
+	var klient *kubernetes.Clientset
+	if klient, err = newKubeClient(cfg); err != nil {
+		return
+	}
+
+	r = NewReconciler(cfg.Options, klient, NewElasticIndexStore(client))
+	return
+}
+
 func main() {
 	var err error
 	defer func(err *error) {
 		if *err != nil {
-			log.Println("exited with error:", (*err).Error())
+			logger.WithError(*err).Error("Exited")
 			os.Exit(1)
 		} else {
-			log.Println("exited")
+			logger.Info("Exited")
 		}
 	}(&err)
 
 	rand.Seed(time.Now().UnixNano())
 
-	var (
-		optDryRun         bool
-		optESURL          string
-		optKubeconfig     string
-		optNamespace      string
-		optTasks          int
-		optDays           int
-		optConfigMap      string
-		optStorageClass   string
-		optStorageRequest string
-		optImage          string
-		optDataMount      string
-		optConfigMapKey   string
-		optNotifyURL      string
-		optBatch          string
-		optIgnores        string
-	)
+	cmd, args := "run", os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		cmd, args = args[0], args[1:]
+	}
 
-	flag.BoolVar(&optDryRun, "dry-run", false, "dry run")
-	flag.StringVar(&optImage, "image", "guoyk/esbridge", "container image")
-	flag.StringVar(&optESURL, "es-url", "http://127.0.0.1:9200", "elasticsearch url")
-	flag.StringVar(&optKubeconfig, "kubeconfig", "kubeconfig", "kubeconfig file")
-	flag.StringVar(&optNamespace, "namespace", "esmaint", "namespace in kubernetes cluster")
-	flag.IntVar(&optTasks, "tasks", 4, "maximum concurrent tasks")
-	flag.IntVar(&optDays, "days", 95, "keep days of indices")
-	flag.StringVar(&optConfigMap, "config-map", "esbridge-cfg", "name of the configmap to feed esbridge")
-	flag.StringVar(&optStorageClass, "storage-class", "local-path", "storage class of pvc")
-	flag.StringVar(&optStorageRequest, "storage-request", "200Gi", "storage request for pvc")
-	flag.StringVar(&optDataMount, "data-mount", "/data", "data directory mount for job")
-	flag.StringVar(&optConfigMapKey, "config-map-key", "esbridge.yml", "key in config map")
-	flag.StringVar(&optNotifyURL, "notify-url", "", "notification url")
-	flag.StringVar(&optBatch, "batch", "2000", "batch size")
-	flag.StringVar(&optIgnores, "ignores", "", "ignore indices")
-	flag.Parse()
-
-	ignores := map[string]bool{}
-
-	ignoreSplit := strings.Split(optIgnores, ",")
-	for _, item := range ignoreSplit {
-		ignores[strings.TrimSpace(item)] = true
-	}
-
-	var candidateIndices []string
-	{
-		midnight := dateMidnight(time.Now())
-
-		var client *elastic.Client
-		if client, err = elastic.NewClient(elastic.SetURL(optESURL), elastic.SetSniff(false)); err != nil {
-			return
-		}
+	switch cmd {
+	case "run":
+		err = runCommand(args)
+	case "plan":
+		err = planCommand(args)
+	case "apply":
+		err = applyCommand(args)
+	case "config":
+		err = configCommand(args)
+	case "indices":
+		err = indicesCommand(args)
+	case "history":
+		err = historyCommand(args)
+	case "status":
+		err = statusCommand(args)
+	case "retry":
+		err = retryCommand(args)
+	case "unquarantine":
+		err = unquarantineCommand(args)
+	default:
+		err = fmt.Errorf("unknown command: %s, available commands: run, plan, apply, config, indices, status, history, retry, unquarantine", cmd)
+	}
+}
 
-		var resp elastic.CatIndicesResponse
-		if resp, err = client.CatIndices().Do(context.Background()); err != nil {
-			return
+// runCommand reconciles once, or continuously with --loop
+func runCommand(args []string) (err error) {
+	var cfg *Config
+	if cfg, err = LoadConfig("run", args, nil); err != nil {
+		return
+	}
+
+	var r *Reconciler
+	if r, err = newReconciler(cfg); err != nil {
+		return
+	}
+
+	if cfg.MetricsAddr != "" || cfg.MetricsPush != "" || cfg.MetricsTextfile != "" {
+		r.Metrics = NewMetrics()
+	}
+
+	if !cfg.Loop {
+		_, err = r.Reconcile(context.Background())
+		if errPush := pushMetrics(cfg, r.Metrics); errPush != nil && err == nil {
+			err = errPush
 		}
+		return
+	}
 
-		for _, row := range resp {
-			if strings.HasPrefix(row.Index, ".") {
-				continue
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	chSig := make(chan os.Signal, 1)
+	signal.Notify(chSig, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-chSig
+		logger.With(Fields{"signal": sig.String()}).Info("Received signal")
+		cancel()
+	}()
+
+	if cfg.MetricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", r.Metrics)
+		server := &http.Server{Addr: cfg.MetricsAddr, Handler: mux}
+		go func() {
+			logger.With(Fields{"addr": cfg.MetricsAddr}).Info("Serving metrics")
+			if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+				logger.WithError(err).Error("Metrics server failed")
 			}
-			if ignores[row.Index] {
-				log.Println("Ignored:", row.Index)
-				continue
-			}
-			var t time.Time
-			var ok bool
-			if t, ok = dateFromIndex(row.Index); !ok {
-				continue
-			}
-			if midnight.Sub(t)/(time.Hour*24) >= time.Duration(optDays) {
-				candidateIndices = append(candidateIndices, row.Index)
-			}
-		}
+		}()
+		defer server.Close()
+	}
 
-		sortCandidateIndices(candidateIndices)
+	err = runController(ctx, r, cfg.Resync.Duration)
+	return
+}
 
-		for _, ci := range candidateIndices {
-			log.Println("Candidate:", ci)
+// pushMetrics pushes metrics of a single pass to pushgateway and textfile if configured
+func pushMetrics(cfg *Config, m *Metrics) (err error) {
+	if m == nil {
+		return
+	}
+	if cfg.MetricsPush != "" {
+		if err = m.Push(context.Background(), cfg.MetricsPush); err != nil {
+			err = fmt.Errorf("failed to push metrics: %s", err.Error())
+			return
+		}
+	}
+	if cfg.MetricsTextfile != "" {
+		if err = m.WriteTextfile(cfg.MetricsTextfile); err != nil {
+			err = fmt.Errorf("failed to write metrics: %s", err.Error())
+			return
 		}
 	}
+	return
+}
 
-	var config *rest.Config
-	if config, err = clientcmd.BuildConfigFromFlags("", optKubeconfig); err != nil {
+// planCommand computes a plan and writes it as json or yaml
+func planCommand(args []string) (err error) {
+	var (
+		optOutput string
+		optOut    string
+	)
+
+	var cfg *Config
+	if cfg, err = LoadConfig("plan", args, func(fs *flag.FlagSet) {
+		fs.StringVar(&optOutput, "output", "yaml", "plan format, json or yaml")
+		fs.StringVar(&optOut, "out", "", "write plan to file instead of stdout")
+	}); err != nil {
 		return
 	}
 
-	var klient *kubernetes.Clientset
-	if klient, err = kubernetes.NewForConfig(config); err != nil {
+	var r *Reconciler
+	if r, err = newReconciler(cfg); err != nil {
 		return
 	}
 
-	// delete orphan pvc
-	var pvcList *corev1.PersistentVolumeClaimList
-	if pvcList, err = klient.CoreV1().PersistentVolumeClaims(optNamespace).List(context.Background(), metav1.ListOptions{
-		LabelSelector: taskSelector,
-	}); err != nil {
+	var plan *Plan
+	if plan, err = r.Plan(context.Background()); err != nil {
 		return
 	}
 
-	for _, pvc := range pvcList.Items {
-		if _, err = klient.BatchV1().Jobs(optNamespace).Get(context.Background(), pvc.Name, metav1.GetOptions{}); err != nil {
-			if errors.IsNotFound(err) {
-				err = nil
-				log.Println("Found Orphan PVC:", pvc.Name)
-				if !optDryRun {
-					if err = klient.CoreV1().PersistentVolumeClaims(optNamespace).Delete(context.Background(), pvc.Name, metav1.DeleteOptions{}); err != nil {
-						return
-					}
-					time.Sleep(time.Second * 5)
-				}
-			} else {
-				return
-			}
-		}
+	var buf []byte
+	if buf, err = marshalOutput(plan, optOutput); err != nil {
+		return
 	}
 
-	// delete pods phase success
-	var podList *corev1.PodList
-	if podList, err = klient.CoreV1().Pods(optNamespace).List(context.Background(), metav1.ListOptions{
-		LabelSelector: taskSelector,
-	}); err != nil {
+	if optOut == "" {
+		_, err = os.Stdout.Write(buf)
 		return
 	}
-	for _, pod := range podList.Items {
-		if pod.Status.Phase == corev1.PodSucceeded {
-			if !optDryRun {
-				log.Println("Found Orphan Pod:", pod.Name)
-				if err = klient.CoreV1().Pods(optNamespace).Delete(context.Background(), pod.Name, metav1.DeleteOptions{}); err != nil {
-					return
-				}
-			}
-		}
-	}
+	err = ioutil.WriteFile(optOut, buf, 0644)
+	return
+}
 
-	// delete completed Job
+// applyCommand executes a plan file, refusing if the cluster drifted since the plan was computed
+func applyCommand(args []string) (err error) {
+	var optPlan string
 
-	var jobList *batchv1.JobList
-	if jobList, err = klient.BatchV1().Jobs(optNamespace).List(context.Background(), metav1.ListOptions{
-		LabelSelector: taskSelector,
+	var cfg *Config
+	if cfg, err = LoadConfig("apply", args, func(fs *flag.FlagSet) {
+		fs.StringVar(&optPlan, "plan", "", "plan file computed by plan command, json or yaml")
 	}); err != nil {
 		return
 	}
 
-	jobCount := len(jobList.Items)
+	if optPlan == "" {
+		err = errors.New("missing --plan")
+		return
+	}
 
-	for _, job := range jobList.Items {
-		var done bool
-		for _, cond := range job.Status.Conditions {
-			if cond.Type == batchv1.JobComplete && cond.Status == corev1.ConditionTrue {
-				done = true
-				log.Println("Saw Complete", job.Name)
-				if optNotifyURL != "" {
-					_ = requo.JSONPost(context.Background(), optNotifyURL, map[string]string{
-						"text": "任务完成: " + job.Name,
-					}, nil)
-				}
-			}
-			if cond.Type == batchv1.JobFailed && cond.Status == corev1.ConditionTrue {
-				done = true
-				log.Println("Saw Failed", job.Name)
-				if optNotifyURL != "" {
-					_ = requo.JSONPost(context.Background(), optNotifyURL, map[string]string{
-						"text": "任务失败: " + job.Name,
-					}, nil)
-				}
-			}
-		}
+	var buf []byte
+	if buf, err = ioutil.ReadFile(optPlan); err != nil {
+		return
+	}
 
-		if !done {
-			log.Println("Saw Ongoing:", job.Name)
-			candidateIndices = removeFromStrSlice(candidateIndices, strings.TrimPrefix(job.Name, taskPrefix))
-			if job.Annotations != nil {
-				candidateIndices = removeFromStrSlice(candidateIndices, job.Annotations[indexAnnotationKey])
-			}
-			continue
-		}
+	plan := &Plan{}
+	if err = yaml.Unmarshal(buf, plan); err != nil {
+		return
+	}
 
-		log.Println("Delete Job", job.Name)
-		if !optDryRun {
-			_ = klient.BatchV1().Jobs(optNamespace).Delete(context.Background(), job.Name, metav1.DeleteOptions{})
-		}
+	var r *Reconciler
+	if r, err = newReconciler(cfg); err != nil {
+		return
+	}
 
-		log.Println("Delete PVC", job.Name)
-		if !optDryRun {
-			_ = klient.CoreV1().PersistentVolumeClaims(optNamespace).Delete(context.Background(), job.Name, metav1.DeleteOptions{})
-		}
+	if err = r.CheckDrift(context.Background(), plan); err != nil {
+		return
+	}
+
+	_, err = r.Apply(context.Background(), plan)
+	return
+}
 
-		time.Sleep(time.Second * 10)
+// configCommand handles config sub commands
+func configCommand(args []string) (err error) {
+	if len(args) == 0 || args[0] != "validate" {
+		err = errors.New("usage: esbridgectl config validate [--config FILE] [flags]")
+		return
+	}
+
+	var cfg *Config
+	if cfg, err = LoadConfig("config validate", args[1:], nil); err != nil {
+		return
+	}
 
-		jobCount--
+	var buf []byte
+	if buf, err = yaml.Marshal(cfg); err != nil {
+		return
 	}
+	_, err = os.Stdout.Write(buf)
+	return
+}
+
+// indicesCommand prints the index inventory with age, retention rule and whether it's a candidate
+func indicesCommand(args []string) (err error) {
+	var optOutput string
 
-	slots := optTasks - jobCount
-	if slots < 0 {
-		slots = 0
+	var cfg *Config
+	if cfg, err = LoadConfig("indices", args, func(fs *flag.FlagSet) {
+		fs.StringVar(&optOutput, "output", "table", "output format, table, json or yaml")
+	}); err != nil {
+		return
 	}
-	log.Println("Remaining Slots:", slots)
 
-	if slots == 0 {
+	var r *Reconciler
+	if r, err = newReconciler(cfg); err != nil {
 		return
 	}
 
-	if slots < len(candidateIndices) {
-		candidateIndices = candidateIndices[0:slots]
+	var items []InventoryItem
+	if items, err = r.Inventory(context.Background()); err != nil {
+		return
 	}
 
-	log.Println("Indices:", strings.Join(candidateIndices, ", "))
+	if optOutput == "table" {
+		err = writeInventoryTable(os.Stdout, items)
+		return
+	}
 
-	for _, index := range candidateIndices {
-		taskName := taskPrefix + strings.ReplaceAll(strings.ReplaceAll(index, "_", "-"), ".", "-")
+	var buf []byte
+	if buf, err = marshalOutput(items, optOutput); err != nil {
+		return
+	}
+	_, err = os.Stdout.Write(buf)
+	return
+}
 
-		pvc := &corev1.PersistentVolumeClaim{}
-		pvc.Namespace = optNamespace
-		pvc.Name = taskName
-		pvc.Labels = map[string]string{
-			taskLabelKey: taskLabelValue,
-		}
-		pvc.Annotations = map[string]string{
-			indexAnnotationKey: index,
-		}
-		pvc.Spec.AccessModes = append(pvc.Spec.AccessModes, corev1.ReadWriteOnce)
-		pvc.Spec.StorageClassName = &optStorageClass
-		pvc.Spec.Resources.Requests = corev1.ResourceList{
-			corev1.ResourceStorage: resource.MustParse(optStorageRequest),
+// historyCommand prints archive history of all indices from ledger, or the record of an index with show
+func historyCommand(args []string) (err error) {
+	var index string
+	if len(args) > 0 && args[0] == "show" {
+		if len(args) < 2 || strings.HasPrefix(args[1], "-") {
+			err = errors.New("usage: esbridgectl history show INDEX [flags]")
+			return
 		}
+		index, args = args[1], args[2:]
+	}
 
-		log.Printf("Create PVC: %+v", pvc)
-		if !optDryRun {
-			if _, err = klient.CoreV1().PersistentVolumeClaims(optNamespace).Create(context.Background(), pvc, metav1.CreateOptions{}); err != nil {
-				return
-			}
-		}
+	var optOutput string
 
-		job := &batchv1.Job{}
-		job.Namespace = optNamespace
-		job.Name = taskName
-		job.Labels = map[string]string{
-			taskLabelKey: taskLabelValue,
-		}
-		job.Annotations = map[string]string{
-			indexAnnotationKey: index,
-		}
-		job.Spec.Template.Labels = map[string]string{
-			"k8s-app":    taskName,
-			taskLabelKey: taskLabelValue,
-		}
-		job.Spec.Template.Annotations = map[string]string{
-			indexAnnotationKey: index,
-			"tke.cloud.tencent.com/vpc-ip-claim-delete-policy": "Immediate",
-		}
-		spec := corev1.PodSpec{}
-
-		container := corev1.Container{}
-
-		container.Name = taskName
-		container.Image = optImage
-		container.ImagePullPolicy = corev1.PullAlways
-		container.Env = append(container.Env, corev1.EnvVar{
-			Name:  "ESBRIDGE_INDEX",
-			Value: index,
-		})
-		container.Env = append(container.Env, corev1.EnvVar{
-			Name:  "ESBRIDGE_BATCH_SIZE",
-			Value: optBatch,
-		})
-		container.Resources.Requests = corev1.ResourceList{
-			corev1.ResourceCPU:    resource.MustParse("2"),
-			corev1.ResourceMemory: resource.MustParse("2000Mi"),
-		}
-		container.Resources.Limits = corev1.ResourceList{
-			corev1.ResourceCPU:    resource.MustParse("2"),
-			corev1.ResourceMemory: resource.MustParse("6000Mi"),
+	var cfg *Config
+	if cfg, err = LoadConfig("history", args, func(fs *flag.FlagSet) {
+		fs.StringVar(&optOutput, "output", "table", "output format, table, json or yaml, show defaults to yaml")
+	}); err != nil {
+		return
+	}
+
+	var klient *kubernetes.Clientset
+	if klient, err = newKubeClient(cfg); err != nil {
+		return
+	}
+
+	var records map[string]LedgerRecord
+	if records, err = NewReconciler(cfg.Options, klient, nil).ledger().Load(context.Background()); err != nil {
+		return
+	}
+
+	var out interface{} = sortLedgerRecords(records)
+	if index != "" {
+		rec, ok := records[index]
+		if !ok {
+			err = fmt.Errorf("no history of index %s", index)
+			return
 		}
-		container.VolumeMounts = []corev1.VolumeMount{
-			{
-				MountPath: "/data",
-				Name:      "vol-data",
-			},
-			{
-				MountPath: "/etc/esbridge.yml",
-				Name:      "vol-cfg",
-				SubPath:   optConfigMapKey,
-			},
+		out = rec
+		if optOutput == "table" {
+			optOutput = "yaml"
 		}
+	}
+
+	if optOutput == "table" {
+		err = writeLedgerTable(os.Stdout, out.([]LedgerRecord))
+		return
+	}
+
+	var buf []byte
+	if buf, err = marshalOutput(out, optOutput); err != nil {
+		return
+	}
+	_, err = os.Stdout.Write(buf)
+	return
+}
 
-		spec.Containers = []corev1.Container{container}
-		spec.RestartPolicy = corev1.RestartPolicyOnFailure
+// retryCommand ends backoff of an index, a quarantined index gets one more attempt
+func retryCommand(args []string) error {
+	return updateLedgerRecord("retry", args, func(rec *LedgerRecord) {
+		rec.NextRetryAt = time.Time{}
+		rec.Quarantined = false
+	})
+}
 
-		volCfg := corev1.Volume{}
-		volCfg.Name = "vol-cfg"
-		volCfg.ConfigMap = &corev1.ConfigMapVolumeSource{}
-		volCfg.ConfigMap.Name = optConfigMap
-		volCfg.ConfigMap.DefaultMode = &accessMode
+// unquarantineCommand releases an index from quarantine and resets its failures
+func unquarantineCommand(args []string) error {
+	return updateLedgerRecord("unquarantine", args, func(rec *LedgerRecord) {
+		rec.NextRetryAt = time.Time{}
+		rec.Quarantined = false
+		rec.Failures = 0
+	})
+}
 
-		volData := corev1.Volume{}
-		volData.Name = "vol-data"
-		volData.PersistentVolumeClaim = &corev1.PersistentVolumeClaimVolumeSource{}
-		volData.PersistentVolumeClaim.ClaimName = taskName
+// updateLedgerRecord updates ledger record of the index in first argument
+func updateLedgerRecord(name string, args []string, update func(rec *LedgerRecord)) (err error) {
+	if len(args) < 1 || strings.HasPrefix(args[0], "-") {
+		err = fmt.Errorf("usage: esbridgectl %s INDEX [flags]", name)
+		return
+	}
+	index, args := args[0], args[1:]
 
-		spec.Volumes = []corev1.Volume{volCfg, volData}
+	var cfg *Config
+	if cfg, err = LoadConfig(name, args, nil); err != nil {
+		return
+	}
 
-		job.Spec.Template.Spec = spec
+	var klient *kubernetes.Clientset
+	if klient, err = newKubeClient(cfg); err != nil {
+		return
+	}
 
-		log.Printf("Create Job: %+v", job)
-		if !optDryRun {
-			if _, err = klient.BatchV1().Jobs(optNamespace).Create(context.Background(), job, metav1.CreateOptions{}); err != nil {
-				return
-			}
-		}
+	l := NewReconciler(cfg.Options, klient, nil).ledger()
 
-		if !optDryRun {
-			time.Sleep(time.Second * 10)
+	var records map[string]LedgerRecord
+	if records, err = l.Load(context.Background()); err != nil {
+		return
+	}
+	rec, ok := records[index]
+	if !ok {
+		err = fmt.Errorf("no history of index %s", index)
+		return
+	}
+	update(&rec)
+	logger.With(Fields{"index": index, "failures": rec.Failures, "quarantined": rec.Quarantined, "dry_run": cfg.DryRun}).Info("Ledger Update")
+	if cfg.DryRun {
+		return
+	}
+	err = l.Put(context.Background(), rec)
+	return
+}
 
-			if pvc, err = klient.CoreV1().PersistentVolumeClaims(optNamespace).Get(context.Background(), taskName, metav1.GetOptions{}); err != nil {
-				return
-			}
+// statusCommand prints managed jobs with live progress, candidate queue and free slots, once or repeatedly with --watch
+func statusCommand(args []string) (err error) {
+	var (
+		optOutput   string
+		optWatch    bool
+		optInterval time.Duration
+	)
 
-			if pvc.Spec.VolumeName == "" {
-				err = fmt.Errorf("failed to locate pv name for pvc: %s", taskName)
-				return
-			}
+	var cfg *Config
+	if cfg, err = LoadConfig("status", args, func(fs *flag.FlagSet) {
+		fs.StringVar(&optOutput, "output", "table", "output format, table, json or yaml, watch mode prints one json per line")
+		fs.BoolVar(&optWatch, "watch", false, "refresh status until interrupted")
+		fs.DurationVar(&optInterval, "interval", time.Second*5, "refresh interval of watch mode")
+	}); err != nil {
+		return
+	}
 
-			log.Println("PV:", pvc.Spec.VolumeName)
+	var r *Reconciler
+	if r, err = newReconciler(cfg); err != nil {
+		return
+	}
 
-			var pv *corev1.PersistentVolume
-			if pv, err = klient.CoreV1().PersistentVolumes().Get(context.Background(), pvc.Spec.VolumeName, metav1.GetOptions{}); err != nil {
+	// status computes a plan, keep its logs out of the output, errors are still logged on exit
+	prev := logger
+	logger = NewLogger(ioutil.Discard, cfg.LogFormat)
+	defer func() {
+		logger = prev
+	}()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	chSig := make(chan os.Signal, 1)
+	signal.Notify(chSig, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		<-chSig
+		cancel()
+	}()
+
+	show := func() (err error) {
+		var s *Status
+		if s, err = r.Status(ctx); err != nil {
+			return
+		}
+		var buf []byte
+		switch {
+		case optOutput == "table":
+			if optWatch {
+				_, _ = os.Stdout.WriteString("\033[H\033[2J" + s.Time.Format(time.RFC3339) + "\n\n")
+			}
+			return writeStatusTable(os.Stdout, s)
+		case optOutput == "json" && optWatch:
+			if buf, err = json.Marshal(s); err != nil {
 				return
 			}
-
-			pv.Spec.PersistentVolumeReclaimPolicy = corev1.PersistentVolumeReclaimDelete
-
-			log.Println("PV Patch:", pvc.Spec.VolumeName)
-			if _, err = klient.CoreV1().PersistentVolumes().Patch(context.Background(), pv.Name, types.StrategicMergePatchType, []byte(PatchRetain), metav1.PatchOptions{}); err != nil {
+			buf = append(buf, '\n')
+		default:
+			if buf, err = marshalOutput(s, optOutput); err != nil {
 				return
 			}
 		}
+		_, err = os.Stdout.Write(buf)
+		return
+	}
+
+	if !optWatch {
+		err = show()
+		return
 	}
 
+	ticker := time.NewTicker(optInterval)
+	defer ticker.Stop()
+	for {
+		if err = show(); err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			_, _ = fmt.Fprintln(os.Stderr, "failed to get status:", err.Error())
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
 }
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+	metricsPushJob     = "esbridgectl"
+)
+
+// taskDurationBuckets are upper bounds in seconds of task duration histogram
+var taskDurationBuckets = []float64{60, 300, 900, 1800, 3600, 7200, 14400, 28800, 86400}
+
+// taskMetricKey labels finished tasks by retention pattern of index and outcome
+type taskMetricKey struct {
+	pattern string
+	outcome string
+}
+
+type durationHistogram struct {
+	buckets []uint64
+	sum     float64
+	count   uint64
+}
+
+// Metrics collects pipeline metrics over reconcile passes, and renders them in prometheus text format
+type Metrics struct {
+	mu sync.Mutex
+
+	candidates      int
+	candidateBytes  int64
+	running         int
+	kept            int
+	quarantined     int
+	notifyPending   int
+	notifyFailures  uint64
+	lastReconcile   time.Time
+	reconciles      uint64
+	reconcileErrors uint64
+	// cleaned is orphan resources deleted by kind
+	cleaned   map[string]uint64
+	finished  map[taskMetricKey]uint64
+	durations map[taskMetricKey]*durationHistogram
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{
+		cleaned:   map[string]uint64{},
+		finished:  map[taskMetricKey]uint64{},
+		durations: map[taskMetricKey]*durationHistogram{},
+	}
+}
+
+// observeReconcile records a reconcile pass, plan is nil if planning failed
+func (m *Metrics) observeReconcile(plan *Plan, res *Result, err error, now time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.reconciles++
+	m.lastReconcile = now
+	if err != nil {
+		m.reconcileErrors++
+	}
+	if plan != nil {
+		m.candidates, m.candidateBytes = plan.Backlog, plan.BacklogBytes
+		m.running, m.kept, m.quarantined = len(plan.Ongoing), len(plan.Kept), len(plan.Quarantined)
+		m.notifyPending = len(plan.NotifyFailures)
+	}
+	if res != nil {
+		m.running += len(res.Scheduled)
+		m.cleaned["pvc"] += uint64(len(res.OrphanPVCs))
+		m.cleaned["pod"] += uint64(len(res.DeletedPods))
+		m.notifyFailures += uint64(len(res.NotifyFailures))
+	}
+}
+
+// observeTask records a finished task once it's put in the ledger, pattern is the retention pattern of its index
+func (m *Metrics) observeTask(pattern string, rec LedgerRecord) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := taskMetricKey{pattern: pattern, outcome: rec.Outcome}
+	m.finished[key]++
+	if rec.StartedAt.IsZero() || rec.FinishedAt.IsZero() {
+		return
+	}
+	h := m.durations[key]
+	if h == nil {
+		h = &durationHistogram{buckets: make([]uint64, len(taskDurationBuckets))}
+		m.durations[key] = h
+	}
+	seconds := rec.FinishedAt.Sub(rec.StartedAt).Seconds()
+	for i, le := range taskDurationBuckets {
+		if seconds <= le {
+			h.buckets[i]++
+		}
+	}
+	h.sum += seconds
+	h.count++
+}
+
+func metricsLabelValue(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+func metricsHeader(w io.Writer, name, typ, help string) {
+	_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+func metricsFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedTaskMetricKeys(keys []taskMetricKey) []taskMetricKey {
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].pattern != keys[j].pattern {
+			return keys[i].pattern < keys[j].pattern
+		}
+		return keys[i].outcome < keys[j].outcome
+	})
+	return keys
+}
+
+// WriteTo writes all metrics in prometheus text format
+func (m *Metrics) WriteTo(w io.Writer) (n int64, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	buf := &bytes.Buffer{}
+
+	for _, g := range []struct {
+		name  string
+		help  string
+		value float64
+	}{
+		{"esbridgectl_candidates", "Candidate indices waiting for a task.", float64(m.candidates)},
+		{"esbridgectl_candidate_bytes", "Primary store size of candidate indices waiting for a task.", float64(m.candidateBytes)},
+		{"esbridgectl_tasks_running", "Tasks running.", float64(m.running)},
+		{"esbridgectl_tasks_kept", "Failed tasks kept for inspection.", float64(m.kept)},
+		{"esbridgectl_indices_quarantined", "Indices quarantined after too many failed tasks.", float64(m.quarantined)},
+		{"esbridgectl_notifications_pending", "Outcomes of finished tasks no notifier delivered, retried by later passes.", float64(m.notifyPending)},
+	} {
+		metricsHeader(buf, g.name, "gauge", g.help)
+		_, _ = fmt.Fprintf(buf, "%s %s\n", g.name, metricsFloat(g.value))
+	}
+
+	var keys []taskMetricKey
+	for key := range m.finished {
+		keys = append(keys, key)
+	}
+	metricsHeader(buf, "esbridgectl_tasks_finished_total", "counter", "Tasks finished by retention pattern of index and outcome.")
+	for _, key := range sortedTaskMetricKeys(keys) {
+		_, _ = fmt.Fprintf(buf, "esbridgectl_tasks_finished_total{pattern=\"%s\",outcome=\"%s\"} %d\n",
+			metricsLabelValue(key.pattern), key.outcome, m.finished[key])
+	}
+
+	keys = nil
+	for key := range m.durations {
+		keys = append(keys, key)
+	}
+	metricsHeader(buf, "esbridgectl_task_duration_seconds", "histogram", "Duration of finished tasks by retention pattern of index and outcome.")
+	for _, key := range sortedTaskMetricKeys(keys) {
+		h := m.durations[key]
+		labels := fmt.Sprintf("pattern=\"%s\",outcome=\"%s\"", metricsLabelValue(key.pattern), key.outcome)
+		for i, le := range taskDurationBuckets {
+			_, _ = fmt.Fprintf(buf, "esbridgectl_task_duration_seconds_bucket{%s,le=\"%s\"} %d\n", labels, metricsFloat(le), h.buckets[i])
+		}
+		_, _ = fmt.Fprintf(buf, "esbridgectl_task_duration_seconds_bucket{%s,le=\"+Inf\"} %d\n", labels, h.count)
+		_, _ = fmt.Fprintf(buf, "esbridgectl_task_duration_seconds_sum{%s} %s\n", labels, metricsFloat(h.sum))
+		_, _ = fmt.Fprintf(buf, "esbridgectl_task_duration_seconds_count{%s} %d\n", labels, h.count)
+	}
+
+	metricsHeader(buf, "esbridgectl_orphans_cleaned_total", "counter", "Orphan resources deleted by kind.")
+	for _, kind := range []string{"pod", "pvc"} {
+		_, _ = fmt.Fprintf(buf, "esbridgectl_orphans_cleaned_total{kind=\"%s\"} %d\n", kind, m.cleaned[kind])
+	}
+
+	metricsHeader(buf, "esbridgectl_notify_failures_total", "counter", "Notifications a notifier failed to deliver after retries.")
+	_, _ = fmt.Fprintf(buf, "esbridgectl_notify_failures_total %d\n", m.notifyFailures)
+
+	metricsHeader(buf, "esbridgectl_reconciles_total", "counter", "Reconcile passes.")
+	_, _ = fmt.Fprintf(buf, "esbridgectl_reconciles_total %d\n", m.reconciles)
+	metricsHeader(buf, "esbridgectl_reconcile_errors_total", "counter", "Reconcile passes failed.")
+	_, _ = fmt.Fprintf(buf, "esbridgectl_reconcile_errors_total %d\n", m.reconcileErrors)
+	if !m.lastReconcile.IsZero() {
+		metricsHeader(buf, "esbridgectl_last_reconcile_timestamp_seconds", "gauge", "Time of the last reconcile pass.")
+		_, _ = fmt.Fprintf(buf, "esbridgectl_last_reconcile_timestamp_seconds %d\n", m.lastReconcile.Unix())
+	}
+
+	return buf.WriteTo(w)
+}
+
+// ServeHTTP serves metrics on /metrics
+func (m *Metrics) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	rw.Header().Set("Content-Type", metricsContentType)
+	_, _ = m.WriteTo(rw)
+}
+
+// Push replaces metrics of esbridgectl job in pushgateway at url
+func (m *Metrics) Push(ctx context.Context, url string) (err error) {
+	buf := &bytes.Buffer{}
+	if _, err = m.WriteTo(buf); err != nil {
+		return
+	}
+	var req *http.Request
+	if req, err = http.NewRequest(http.MethodPut, strings.TrimSuffix(url, "/")+"/metrics/job/"+metricsPushJob, buf); err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", metricsContentType)
+	var resp *http.Response
+	if resp, err = http.DefaultClient.Do(req.WithContext(ctx)); err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		err = fmt.Errorf("pushgateway responded %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return
+}
+
+// WriteTextfile writes metrics to file atomically, for node exporter textfile collector
+func (m *Metrics) WriteTextfile(file string) (err error) {
+	var f *os.File
+	if f, err = ioutil.TempFile(filepath.Dir(file), filepath.Base(file)+".*.tmp"); err != nil {
+		return
+	}
+	defer os.Remove(f.Name())
+	if _, err = m.WriteTo(f); err != nil {
+		_ = f.Close()
+		return
+	}
+	if err = f.Close(); err != nil {
+		return
+	}
+	if err = os.Chmod(f.Name(), 0644); err != nil {
+		return
+	}
+	err = os.Rename(f.Name(), file)
+	return
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReconcilerMetrics(t *testing.T) {
+	opts := testOptions()
+	opts.Tasks = 1
+	opts.Retention = []RetentionRule{{Pattern: "debug-*", Days: 3}}
+	r, kube := newTestReconciler(t, opts, []map[string]string{
+		{"index": "a-2021-01-01", "pri.store.size": strconv.Itoa(testGi)},
+		{"index": "b-2021-01-01", "pri.store.size": strconv.Itoa(testGi * 2)},
+		{"index": "c-2021-01-01", "pri.store.size": strconv.Itoa(testGi * 4)},
+		{"index": "debug-2021-03-01"},
+	})
+	r.Metrics = NewMetrics()
+
+	started := time.Date(2021, 3, 10, 6, 0, 0, 0, time.UTC)
+	job := finishedJob("debug-2021-03-01", batchv1.JobComplete)
+	job.Status.StartTime = &metav1.Time{Time: started}
+	job.Status.CompletionTime = &metav1.Time{Time: started.Add(20 * time.Minute)}
+	kube.Add(job)
+	kube.Add(&corev1.PersistentVolumeClaim{ObjectMeta: taskObjectMeta("task-orphan", "orphan")})
+
+	if _, err := r.Reconcile(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	buf := &bytes.Buffer{}
+	if _, err := r.Metrics.WriteTo(buf); err != nil {
+		t.Fatal(err)
+	}
+	out := buf.String()
+	for _, line := range []string{
+		"# TYPE esbridgectl_candidates gauge",
+		// a is scheduled, suspicious debug-2021-03-01 is not archived again
+		"esbridgectl_candidates 2",
+		"esbridgectl_candidate_bytes 6.442450944e+09",
+		"esbridgectl_tasks_running 1",
+		`esbridgectl_tasks_finished_total{pattern="debug-*",outcome="complete"} 1`,
+		`esbridgectl_task_duration_seconds_bucket{pattern="debug-*",outcome="complete",le="900"} 0`,
+		`esbridgectl_task_duration_seconds_bucket{pattern="debug-*",outcome="complete",le="1800"} 1`,
+		`esbridgectl_task_duration_seconds_bucket{pattern="debug-*",outcome="complete",le="+Inf"} 1`,
+		`esbridgectl_task_duration_seconds_sum{pattern="debug-*",outcome="complete"} 1200`,
+		`esbridgectl_orphans_cleaned_total{kind="pvc"} 1`,
+		"esbridgectl_reconciles_total 1",
+		"esbridgectl_reconcile_errors_total 0",
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("metrics missing %s", line)
+		}
+	}
+	if t.Failed() {
+		t.Fatal(out)
+	}
+
+	// a failed pass is counted, metrics of last plan are kept
+	kube.Reject = func(method, resource, name string) bool {
+		return method == http.MethodGet && resource == "persistentvolumeclaims"
+	}
+	if _, err := r.Reconcile(context.Background()); err == nil {
+		t.Fatal("expected error")
+	}
+	buf.Reset()
+	_, _ = r.Metrics.WriteTo(buf)
+	if out = buf.String(); !strings.Contains(out, "esbridgectl_reconcile_errors_total 1\n") || !strings.Contains(out, "esbridgectl_tasks_running 1\n") {
+		t.Fatal(out)
+	}
+}
+
+func TestMetricsPushAndTextfile(t *testing.T) {
+	m := NewMetrics()
+	m.observeReconcile(&Plan{Backlog: 1}, &Result{}, nil, time.Unix(1600000000, 0))
+
+	var pushed string
+	server := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodPut || req.URL.Path != "/metrics/job/esbridgectl" {
+			rw.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		buf, _ := ioutil.ReadAll(req.Body)
+		pushed = string(buf)
+	}))
+	defer server.Close()
+
+	if err := m.Push(context.Background(), server.URL+"/"); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(pushed, "esbridgectl_candidates 1\n") || !strings.Contains(pushed, "esbridgectl_last_reconcile_timestamp_seconds 1600000000\n") {
+		t.Fatalf("pushed = %s", pushed)
+	}
+	if err := m.Push(context.Background(), server.URL+"/bad"); err == nil || !strings.Contains(err.Error(), "pushgateway responded 400") {
+		t.Fatalf("err = %v", err)
+	}
+
+	dir, err := ioutil.TempDir("", "esbridgectl")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "esbridgectl.prom")
+	if err = m.WriteTextfile(file); err != nil {
+		t.Fatal(err)
+	}
+	buf, _ := ioutil.ReadFile(file)
+	if string(buf) != pushed {
+		t.Fatalf("textfile = %s", buf)
+	}
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Fatalf("files = %v, want temporary file removed", files)
+	}
+}
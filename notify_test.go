@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeHook records posted bodies, failing the first fails requests
+type fakeHook struct {
+	mu     sync.Mutex
+	fails  int
+	bodies []string
+	URL    string
+}
+
+func newFakeHook(t *testing.T, fails int) *fakeHook {
+	h := &fakeHook{fails: fails}
+	s := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		h.mu.Lock()
+		defer h.mu.Unlock()
+		if h.fails > 0 {
+			h.fails--
+			rw.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		buf, _ := ioutil.ReadAll(req.Body)
+		h.bodies = append(h.bodies, string(buf))
+	}))
+	t.Cleanup(s.Close)
+	h.URL = s.URL
+	return h
+}
+
+func (h *fakeHook) Bodies() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]string{}, h.bodies...)
+}
+
+func TestNotifierBackends(t *testing.T) {
+	e := Event{Index: "a-2021-01-01", Job: "task-a-2021-01-01", Outcome: OutcomeFailed, Bytes: 2048, Reason: "BackoffLimitExceeded", Logs: "boom"}
+	e.Duration.Duration = time.Minute
+	e.Verification = &Verification{Status: VerificationSuspicious, Reason: "missing checksum", Manifest: &Manifest{Location: "s3://archive/a"}}
+
+	for _, tc := range []struct {
+		cfg  NotifierConfig
+		want []string
+	}{
+		{NotifierConfig{Type: NotifierWebhook, Template: legacyTemplate}, []string{`{"text":"任务失败: task-a-2021-01-01"}`}},
+		{NotifierConfig{Type: NotifierWebhook}, []string{`"index":"a-2021-01-01"`, `"duration":"1m0s"`, `"bytes":2048`}},
+		{NotifierConfig{Type: NotifierWebhook, Template: `{"index": {{json .Index}}, "size": "{{bytes .Bytes}}"}`}, []string{`{"index":"a-2021-01-01","size":"2.0Ki"}`}},
+		{NotifierConfig{Type: NotifierDingTalk}, []string{`"msgtype":"markdown"`, `"title":"任务失败: task-a-2021-01-01"`, `- reason: BackoffLimitExceeded`, "boom", "- verification: suspicious (missing checksum)\n- location: s3://archive/a"}},
+		{NotifierConfig{Type: NotifierWeCom}, []string{`"content":"**任务失败: task-a-2021-01-01**`}},
+		{NotifierConfig{Type: NotifierLark}, []string{`"msg_type":"interactive"`, `"tag":"markdown"`}},
+		{NotifierConfig{Type: NotifierSlack}, []string{`"type":"mrkdwn"`}},
+	} {
+		hook := newFakeHook(t, 0)
+		tc.cfg.URL = hook.URL
+		n, err := newNotifier(tc.cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = n.Notify(context.Background(), e); err != nil {
+			t.Fatal(err)
+		}
+		bodies := hook.Bodies()
+		if len(bodies) != 1 {
+			t.Fatalf("%s: bodies = %v", tc.cfg.Type, bodies)
+		}
+		// compact to compare regardless of spacing
+		var v interface{}
+		if err = json.Unmarshal([]byte(bodies[0]), &v); err != nil {
+			t.Fatal(err)
+		}
+		compact, _ := json.Marshal(v)
+		for _, want := range tc.want {
+			if !strings.Contains(string(compact), strings.ReplaceAll(want, "\n", `\n`)) {
+				t.Errorf("%s: body %s does not contain %s", tc.cfg.Type, compact, want)
+			}
+		}
+	}
+
+	if _, err := newNotifier(NotifierConfig{Type: NotifierSMTP, URL: "smtp://mail:25"}); err == nil {
+		t.Error("expected error for smtp without addresses")
+	}
+	if _, err := newNotifier(NotifierConfig{Type: "pager", URL: "http://a"}); err == nil {
+		t.Error("expected error for unknown type")
+	}
+	msg := string(smtpMessage("a@example.com", []string{"b@example.com", "c@example.com"}, "任务完成", "line1\nline2"))
+	if !strings.Contains(msg, "To: b@example.com, c@example.com\r\n") || !strings.HasSuffix(msg, "\r\n\r\nline1\r\nline2") {
+		t.Errorf("smtp message = %q", msg)
+	}
+}
+
+func TestReconcilerNotifies(t *testing.T) {
+	flaky := newFakeHook(t, 2)
+	down := newFakeHook(t, 100)
+
+	opts := testOptions()
+	opts.Tasks = 0
+	opts.NotifyRetries = 2
+	opts.Notifiers = []NotifierConfig{
+		{Type: NotifierWebhook, URL: flaky.URL},
+		{Type: NotifierWebhook, URL: down.URL},
+	}
+	r, kube := newTestReconciler(t, opts, nil)
+
+	job := finishedJob("a-2021-01-01", batchv1.JobFailed)
+	job.Annotations[sizeAnnotationKey] = "1024"
+	job.Status.StartTime = &metav1.Time{Time: time.Date(2021, 3, 10, 6, 0, 0, 0, time.UTC)}
+	job.Status.Conditions[0].Reason = "BackoffLimitExceeded"
+	job.Status.Conditions[0].LastTransitionTime = metav1.Time{Time: time.Date(2021, 3, 10, 7, 30, 0, 0, time.UTC)}
+	kube.Add(job)
+	pod := &corev1.Pod{ObjectMeta: taskObjectMeta("task-a-2021-01-01-xxxxx", "a-2021-01-01"), Status: corev1.PodStatus{Phase: corev1.PodFailed}}
+	pod.Labels["job-name"] = job.Name
+	kube.Add(pod)
+	kube.SetLog(testNamespace, pod.Name, "line1\nline2\nfatal: boom\n")
+
+	res, err := r.Reconcile(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bodies := flaky.Bodies()
+	if len(bodies) != 1 {
+		t.Fatalf("bodies = %v, want delivered once after retries", bodies)
+	}
+	e := Event{}
+	if err = json.Unmarshal([]byte(bodies[0]), &e); err != nil {
+		t.Fatal(err)
+	}
+	if e.Reason != "BackoffLimitExceeded" || e.Bytes != 1024 || e.Duration.Duration != time.Minute*90 || !strings.HasSuffix(e.Logs, "fatal: boom") {
+		t.Fatalf("event = %+v", e)
+	}
+	if len(res.NotifyFailures) != 1 || !strings.Contains(res.NotifyFailures[0], "task-a-2021-01-01") {
+		t.Fatalf("notify failures = %v", res.NotifyFailures)
+	}
+}
+
+func TestReconcilerRetriesUndeliveredNotification(t *testing.T) {
+	hook := newFakeHook(t, 1)
+
+	opts := testOptions()
+	opts.Tasks = 0
+	opts.NotifyRetries = 0
+	opts.NotifyURL = hook.URL
+	r, kube := newTestReconciler(t, opts, nil)
+	r.Metrics = NewMetrics()
+	kube.Add(finishedJob("a-2021-01-01", batchv1.JobFailed))
+
+	res, err := r.Reconcile(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.NotifyFailures) != 1 || len(kube.Names("jobs")) != 0 {
+		t.Fatalf("notify failures = %v, jobs = %v", res.NotifyFailures, kube.Names("jobs"))
+	}
+	records, err := r.ledger().Load(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec := records["a-2021-01-01"]; rec.NotifyError == "" || rec.PendingEvent == nil || rec.PendingEvent.Job != "task-a-2021-01-01" {
+		t.Fatalf("record = %+v", rec)
+	}
+
+	// the failure is surfaced by status and metrics, and the notification is retried by the next pass
+	s, err := r.Status(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.NotifyFailures) != 1 || !strings.HasPrefix(s.NotifyFailures[0], "a-2021-01-01: ") {
+		t.Fatalf("status notify failures = %v", s.NotifyFailures)
+	}
+	if _, err = r.Reconcile(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if bodies := hook.Bodies(); len(bodies) != 1 || bodies[0] != `{"text":"任务失败: task-a-2021-01-01"}` {
+		t.Fatalf("bodies = %v", bodies)
+	}
+	buf := &bytes.Buffer{}
+	_, _ = r.Metrics.WriteTo(buf)
+	if out := buf.String(); !strings.Contains(out, "esbridgectl_notify_failures_total 1\n") || !strings.Contains(out, "esbridgectl_notifications_pending 1\n") {
+		t.Fatal(out)
+	}
+
+	if records, err = r.ledger().Load(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if rec := records["a-2021-01-01"]; rec.NotifyError != "" || rec.PendingEvent != nil {
+		t.Fatalf("record = %+v", rec)
+	}
+	if _, err = r.Reconcile(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if bodies := hook.Bodies(); len(bodies) != 1 {
+		t.Fatalf("bodies = %v, want notified once", bodies)
+	}
+}
+
+func TestReconcilerRetriesFailedNotifiersOnly(t *testing.T) {
+	up := newFakeHook(t, 0)
+	down := newFakeHook(t, 1)
+
+	opts := testOptions()
+	opts.Tasks = 0
+	opts.NotifyRetries = 0
+	opts.Notifiers = []NotifierConfig{
+		{Type: NotifierWebhook, URL: up.URL},
+		{Type: NotifierWebhook, URL: down.URL},
+	}
+	r, kube := newTestReconciler(t, opts, nil)
+	kube.Add(finishedJob("a-2021-01-01", batchv1.JobFailed))
+
+	if _, err := r.Reconcile(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	records, err := r.ledger().Load(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{"webhook(" + strings.TrimPrefix(down.URL, "http://") + ")"}
+	if rec := records["a-2021-01-01"]; rec.PendingEvent == nil || !reflect.DeepEqual(rec.FailedNotifiers, names) {
+		t.Fatalf("record = %+v, want failed notifiers %v", rec, names)
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err = r.Reconcile(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(up.Bodies()) != 1 || len(down.Bodies()) != 1 {
+		t.Fatalf("bodies = %v, %v, want each delivered once", up.Bodies(), down.Bodies())
+	}
+	if records, err = r.ledger().Load(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if rec := records["a-2021-01-01"]; rec.PendingEvent != nil || rec.FailedNotifiers != nil || rec.NotifyError != "" {
+		t.Fatalf("record = %+v", rec)
+	}
+}
+
+func TestSendMailDeadline(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	// accept and never greet
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+	defer cancel()
+	start := time.Now()
+	if err = sendMail(ctx, l.Addr().String(), nil, "a@example.com", []string{"b@example.com"}, []byte("hello")); err == nil {
+		t.Fatal("expected timeout")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second*5 {
+		t.Fatalf("sendMail took %s", elapsed)
+	}
+}
+
+func TestReconcilerNotifiesOnce(t *testing.T) {
+	hook := newFakeHook(t, 0)
+
+	opts := testOptions()
+	opts.Tasks = 0
+	opts.NotifyURL = hook.URL
+	r, kube := newTestReconciler(t, opts, nil)
+	kube.Add(finishedJob("a-2021-01-01", batchv1.JobComplete))
+	kube.Add(finishedJob("b-2021-01-01", batchv1.JobComplete))
+
+	// dry run never notifies
+	r.Options.DryRun = true
+	if _, err := r.Reconcile(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if bodies := hook.Bodies(); len(bodies) != 0 {
+		t.Fatalf("bodies = %v, want none in dry run", bodies)
+	}
+	r.Options.DryRun = false
+
+	// job a survives a failed delete
+	kube.Reject = func(method, resource, name string) bool {
+		return method == http.MethodDelete && name == "task-a-2021-01-01"
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := r.Reconcile(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if want := []string{`{"text":"任务完成: task-a-2021-01-01"}`, `{"text":"任务完成: task-b-2021-01-01"}`}; strings.Join(hook.Bodies(), ",") != strings.Join(want, ",") {
+		t.Fatalf("bodies = %v, want %v", hook.Bodies(), want)
+	}
+	job := &batchv1.Job{}
+	if !kube.Get(job, testNamespace, "task-a-2021-01-01") || job.Annotations[notifiedAnnotationKey] == "" {
+		t.Fatalf("job annotations = %v, want notified", job.Annotations)
+	}
+}
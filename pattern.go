@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// indexMatcher reports whether an index matches a pattern
+type indexMatcher func(index string) bool
+
+// compileIndexPattern compiles a glob like "access-prod-*", or a regular expression wrapped in slashes like "/^debug-/"
+func compileIndexPattern(pattern string) (m indexMatcher, err error) {
+	if len(pattern) > 1 && strings.HasPrefix(pattern, "/") && strings.HasSuffix(pattern, "/") {
+		var re *regexp.Regexp
+		if re, err = regexp.Compile(pattern[1 : len(pattern)-1]); err != nil {
+			err = fmt.Errorf("invalid index pattern %s: %s", pattern, err.Error())
+			return
+		}
+		m = re.MatchString
+		return
+	}
+	if _, err = path.Match(pattern, ""); err != nil {
+		err = fmt.Errorf("invalid index pattern %s: %s", pattern, err.Error())
+		return
+	}
+	m = func(index string) bool {
+		ok, _ := path.Match(pattern, index)
+		return ok
+	}
+	return
+}
+
+// compileIndexPatterns compiles patterns into a matcher of any of them, it matches nothing if patterns are empty
+func compileIndexPatterns(patterns []string) (m indexMatcher, err error) {
+	var matchers []indexMatcher
+	for _, pattern := range patterns {
+		var one indexMatcher
+		if one, err = compileIndexPattern(pattern); err != nil {
+			return
+		}
+		matchers = append(matchers, one)
+	}
+	m = func(index string) bool {
+		for _, one := range matchers {
+			if one(index) {
+				return true
+			}
+		}
+		return false
+	}
+	return
+}
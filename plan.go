@@ -0,0 +1,813 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"sort"
+	"strings"
+	"time"
+)
+
+type ActionKind string
+
+const (
+	ActionDeletePVC ActionKind = "delete-pvc"
+	ActionDeletePod ActionKind = "delete-pod"
+	ActionDeleteJob ActionKind = "delete-job"
+	ActionCreatePVC ActionKind = "create-pvc"
+	ActionCreateJob ActionKind = "create-job"
+	ActionPatchPV   ActionKind = "patch-pv"
+
+	ActionDeleteIndex ActionKind = "delete-index"
+	ActionCloseIndex  ActionKind = "close-index"
+
+	ActionDeleteConfigMap ActionKind = "delete-configmap"
+	ActionRecord          ActionKind = "record"
+	// ActionNotify notifies outcome of a job kept after it failed
+	ActionNotify ActionKind = "notify"
+)
+
+const (
+	ReasonOrphan   = "orphan"
+	ReasonFinished = "finished"
+
+	OutcomeComplete = "complete"
+	OutcomeFailed   = "failed"
+)
+
+// Action is a single change to the cluster
+type Action struct {
+	Kind  ActionKind `json:"kind"`
+	Index string     `json:"index,omitempty"`
+	// Name of the object, for patch-pv it's the name of pvc bound to the pv
+	Name string `json:"name"`
+	// Reason why a pvc or pod is deleted, orphan or finished
+	Reason string `json:"reason,omitempty"`
+	// Outcome of a finished job, complete or failed
+	Outcome string `json:"outcome,omitempty"`
+
+	PVC *corev1.PersistentVolumeClaim `json:"pvc,omitempty"`
+	Job *batchv1.Job                  `json:"job,omitempty"`
+	// Event to notify for delete-job and notify
+	Event *Event `json:"event,omitempty"`
+	// Notified is true if the outcome of job was notified in a previous run
+	Notified bool `json:"notified,omitempty"`
+	// Pending is true if notify retries a notification kept in ledger, its job is gone
+	Pending bool `json:"pending,omitempty"`
+	// Record to put in ledger, shared by actions of the index
+	Record *LedgerRecord `json:"record,omitempty"`
+}
+
+// Fields returns log fields of action, name is keyed by the kind of object
+func (a Action) Fields() Fields {
+	f := Fields{"action": string(a.Kind)}
+	if a.Index != "" {
+		f["index"] = a.Index
+	}
+	switch a.Kind {
+	case ActionDeletePVC, ActionCreatePVC, ActionPatchPV:
+		f["pvc"] = a.Name
+	case ActionDeletePod:
+		f["pod"] = a.Name
+	case ActionDeleteJob, ActionCreateJob, ActionNotify:
+		f["job"] = a.Name
+	case ActionDeleteConfigMap:
+		f["configmap"] = a.Name
+	}
+	if a.Reason != "" {
+		f["reason"] = a.Reason
+	}
+	if a.Outcome != "" {
+		f["outcome"] = a.Outcome
+	}
+	return f
+}
+
+func (a Action) String() string {
+	if a.Index == "" {
+		return fmt.Sprintf("%s %s", a.Kind, a.Name)
+	}
+	return fmt.Sprintf("%s %s (%s)", a.Kind, a.Name, a.Index)
+}
+
+// Plan is the list of actions computed from an observed state
+type Plan struct {
+	Namespace  string    `json:"namespace"`
+	CreatedAt  time.Time `json:"createdAt"`
+	Candidates []string  `json:"candidates"`
+	Ongoing    []string  `json:"ongoing"`
+	Slots      int       `json:"slots"`
+	// Queue are candidates without a task in scheduling order, first ones are scheduled by this plan
+	Queue []string `json:"queue,omitempty"`
+	// Backlog and BacklogBytes are count and primary store size of candidates left in queue after this plan
+	Backlog      int   `json:"backlog"`
+	BacklogBytes int64 `json:"backlogBytes"`
+	// Deferred are candidates not scheduled because their storage does not fit the budgets
+	Deferred []string `json:"deferred,omitempty"`
+	// Verified are indices of completed tasks with archive matching the index
+	Verified []string `json:"verified,omitempty"`
+	// Suspicious are archives not matching their index, with reasons
+	Suspicious []string `json:"suspicious,omitempty"`
+	// Quarantined are indices not archived again after too many failed tasks
+	Quarantined []string `json:"quarantined,omitempty"`
+	// Kept are failed jobs kept for inspection
+	Kept []string `json:"kept,omitempty"`
+	// NotifyFailures are indices whose last outcome no notifier delivered, with errors
+	NotifyFailures []string `json:"notifyFailures,omitempty"`
+	Actions        []Action `json:"actions"`
+	// State is the observed state the plan is computed from, used to detect drift
+	State []string `json:"state"`
+}
+
+// Plan observes elasticsearch and the cluster, and computes actions without changing anything
+func (r *Reconciler) Plan(ctx context.Context) (plan *Plan, err error) {
+	opts := r.Options
+	log := r.log()
+
+	plan = &Plan{
+		Namespace: opts.Namespace,
+		CreatedAt: r.Now(),
+	}
+
+	var records map[string]LedgerRecord
+	if records, err = r.ledger().Load(ctx); err != nil {
+		return
+	}
+
+	var items []InventoryItem
+	if items, err = r.inventory(ctx, records); err != nil {
+		return
+	}
+	infos := map[string]IndexInfo{}
+	for _, item := range items {
+		infos[item.Name] = item.IndexInfo
+	}
+
+	var candidates []Candidate
+	if candidates, err = r.candidatesOf(items); err != nil {
+		return
+	}
+	byIndex := map[string]Candidate{}
+	var candidateIndices []string
+	for _, c := range candidates {
+		byIndex[c.Index] = c
+		candidateIndices = append(candidateIndices, c.Index)
+		plan.State = append(plan.State, "candidate/"+c.Index)
+	}
+	plan.Candidates = candidateIndices
+
+	listOpts := metav1.ListOptions{LabelSelector: taskSelector}
+
+	var pvcList *corev1.PersistentVolumeClaimList
+	if pvcList, err = r.Kube.CoreV1().PersistentVolumeClaims(opts.Namespace).List(ctx, listOpts); err != nil {
+		return
+	}
+	var podList *corev1.PodList
+	if podList, err = r.Kube.CoreV1().Pods(opts.Namespace).List(ctx, listOpts); err != nil {
+		return
+	}
+	var jobList *batchv1.JobList
+	if jobList, err = r.Kube.BatchV1().Jobs(opts.Namespace).List(ctx, listOpts); err != nil {
+		return
+	}
+
+	jobs := map[string]bool{}
+	completeJobs := map[string]bool{}
+	notifiedJobs := map[string]bool{}
+	for i := range jobList.Items {
+		job := &jobList.Items[i]
+		jobs[job.Name] = true
+		notifiedJobs[job.Name] = job.Annotations[notifiedAnnotationKey] != ""
+		completeJobs[job.Name] = jobHasCondition(job, batchv1.JobComplete)
+	}
+	pvcs := map[string]bool{}
+	pvcStorage := map[string]int64{}
+
+	// delete orphan pvc
+	for _, pvc := range pvcList.Items {
+		pvcs[pvc.Name] = true
+		pvcStorage[pvc.Name] = pvc.Spec.Resources.Requests.Storage().Value()
+		plan.State = append(plan.State, "pvc/"+pvc.Name)
+		if jobs[pvc.Name] {
+			continue
+		}
+		log.With(Fields{"pvc": pvc.Name, "index": pvc.Annotations[indexAnnotationKey]}).Info("Found Orphan PVC")
+		plan.Actions = append(plan.Actions, Action{
+			Kind:   ActionDeletePVC,
+			Index:  pvc.Annotations[indexAnnotationKey],
+			Name:   pvc.Name,
+			Reason: ReasonOrphan,
+		})
+	}
+
+	// succeeded pods are deleted once their task is recorded or their job is gone
+	podNodes := map[string]string{}
+	succeededPods := map[string][]string{}
+	for _, pod := range podList.Items {
+		jobName := pod.Labels["job-name"]
+		if pod.Spec.NodeName != "" && jobName != "" {
+			podNodes[jobName] = pod.Spec.NodeName
+		}
+		if pod.Status.Phase != corev1.PodSucceeded {
+			continue
+		}
+		if jobs[jobName] {
+			if completeJobs[jobName] {
+				plan.State = append(plan.State, "pod/"+pod.Name+":"+string(pod.Status.Phase))
+				succeededPods[jobName] = append(succeededPods[jobName], pod.Name)
+			}
+			continue
+		}
+		log.With(Fields{"pod": pod.Name, "index": pod.Annotations[indexAnnotationKey]}).Info("Found Orphan Pod")
+		plan.State = append(plan.State, "pod/"+pod.Name+":"+string(pod.Status.Phase))
+		plan.Actions = append(plan.Actions, Action{
+			Kind:   ActionDeletePod,
+			Index:  pod.Annotations[indexAnnotationKey],
+			Name:   pod.Name,
+			Reason: ReasonOrphan,
+		})
+	}
+
+	// delete completed Job
+	retry := newRetryPolicy(opts)
+	reported := map[string]bool{}
+	removing := map[string]bool{}
+	// actions of an index share its record, so each puts it with the outcomes of the ones before
+	shared := map[string]*LedgerRecord{}
+	recordOf := func(index string) *LedgerRecord {
+		if index == "" {
+			return nil
+		}
+		if shared[index] == nil {
+			rec := records[index]
+			shared[index] = &rec
+		}
+		return shared[index]
+	}
+	jobCount := len(jobList.Items)
+	var inFlight int64
+	inFlightByNode := map[string]int64{}
+
+	for _, job := range jobList.Items {
+		index := job.Annotations[indexAnnotationKey]
+		jobLog := log.With(Fields{"job": job.Name, "index": index})
+
+		var outcome string
+		for _, cond := range job.Status.Conditions {
+			if cond.Type == batchv1.JobComplete && cond.Status == corev1.ConditionTrue {
+				outcome = OutcomeComplete
+			}
+			if cond.Type == batchv1.JobFailed && cond.Status == corev1.ConditionTrue {
+				outcome = OutcomeFailed
+			}
+		}
+
+		if outcome == "" {
+			jobLog.Info("Saw Ongoing")
+			plan.State = append(plan.State, "job/"+job.Name)
+			plan.Ongoing = append(plan.Ongoing, job.Name)
+			storage := taskStorage(job, pvcStorage)
+			inFlight += storage
+			if node := taskNode(job, podNodes); node != "" {
+				inFlightByNode[node] += storage
+			}
+			candidateIndices = removeFromStrSlice(candidateIndices, strings.TrimPrefix(job.Name, taskPrefix))
+			if index != "" {
+				candidateIndices = removeFromStrSlice(candidateIndices, index)
+			}
+			continue
+		}
+
+		jobLog.With(Fields{"outcome": outcome}).Info("Saw Finished")
+		plan.State = append(plan.State, "job/"+job.Name+":"+outcome)
+
+		var (
+			verification *Verification
+			hasConfigMap bool
+		)
+		if outcome == OutcomeComplete {
+			var v Verification
+			v, hasConfigMap = r.verifyTask(ctx, job, podList.Items, infos)
+			verification = &v
+			if v.Status == VerificationVerified {
+				plan.Verified = append(plan.Verified, index)
+			} else {
+				plan.Suspicious = append(plan.Suspicious, index+": "+v.Reason)
+				reported[index] = true
+			}
+		}
+
+		notified := job.Annotations[notifiedAnnotationKey] != ""
+
+		event := r.jobEvent(ctx, job, outcome, podList.Items)
+		if verification != nil {
+			event.Verification = verification
+			if verification.Manifest != nil {
+				event.Bytes = verification.Manifest.Bytes
+			}
+		}
+		// diagnose failed task once for ledger and notification, before its pod is gone
+		if outcome == OutcomeFailed && (!notified || (index != "" && !records[index].recorded(job))) {
+			d := r.diagnoseTask(ctx, job, podList.Items)
+			event.Diagnostics = d
+			event.Logs = tailLines(d.Logs, opts.NotifyLogLines)
+			event.addReason(d.Summary())
+		}
+		if rec, ok := ledgerRecord(records[index], job, outcome, verification, event); ok && index != "" {
+			retry.apply(&rec, plan.CreatedAt)
+			records[index] = rec
+			if rec.Quarantined {
+				event.addReason(fmt.Sprintf("quarantined after %d failed attempts", rec.Failures))
+			}
+			if rec.waiting(plan.CreatedAt) != "" {
+				candidateIndices = removeFromStrSlice(candidateIndices, index)
+			}
+			plan.Actions = append(plan.Actions, Action{Kind: ActionRecord, Index: index, Name: index, Record: &rec})
+		}
+
+		// keep failed job and its pvc for inspection, like an ongoing one without a slot
+		if keepUntil := r.keepFailedUntil(job, outcome); keepUntil.After(plan.CreatedAt) {
+			jobLog.With(Fields{"until": keepUntil}).Info("Keep Failed")
+			plan.Kept = append(plan.Kept, job.Name)
+			if !notified {
+				plan.Actions = append(plan.Actions, Action{Kind: ActionNotify, Index: index, Name: job.Name, Outcome: outcome, Event: &event, Record: recordOf(index)})
+			}
+			storage := taskStorage(job, pvcStorage)
+			inFlight += storage
+			if node := taskNode(job, podNodes); node != "" {
+				inFlightByNode[node] += storage
+			}
+			candidateIndices = removeFromStrSlice(candidateIndices, index)
+			jobCount--
+			continue
+		}
+
+		action := Action{
+			Kind:     ActionDeleteJob,
+			Index:    index,
+			Name:     job.Name,
+			Outcome:  outcome,
+			Notified: notified,
+			Record:   recordOf(index),
+		}
+		if !action.Notified {
+			action.Event = &event
+		}
+		plan.Actions = append(plan.Actions, action)
+		for _, pod := range succeededPods[job.Name] {
+			plan.Actions = append(plan.Actions, Action{
+				Kind:   ActionDeletePod,
+				Index:  index,
+				Name:   pod,
+				Reason: ReasonFinished,
+			})
+		}
+		if hasConfigMap {
+			plan.Actions = append(plan.Actions, Action{
+				Kind:  ActionDeleteConfigMap,
+				Index: index,
+				Name:  resultConfigMapName(job.Name),
+			})
+		}
+		if pvcs[job.Name] {
+			plan.Actions = append(plan.Actions, Action{
+				Kind:   ActionDeletePVC,
+				Index:  index,
+				Name:   job.Name,
+				Reason: ReasonFinished,
+			})
+		}
+
+		// remove verified archived index
+		if verification != nil && verification.Status == VerificationVerified && opts.DeleteAfterArchive {
+			kind := ActionDeleteIndex
+			if opts.CloseInstead {
+				kind = ActionCloseIndex
+			}
+			plan.State = append(plan.State, fmt.Sprintf("archive/%s:%d", index, infos[index].DocsCount))
+			plan.Actions = append(plan.Actions, Action{Kind: kind, Index: index, Name: index, Record: recordOf(index)})
+			candidateIndices = removeFromStrSlice(candidateIndices, index)
+			removing[index] = true
+		}
+
+		// index archived just now is not archived again, even if forced, as its task is being cleaned up
+		if outcome == OutcomeComplete {
+			candidateIndices = removeFromStrSlice(candidateIndices, index)
+		}
+
+		jobCount--
+	}
+
+	// retry removal of verified archived indices still in elasticsearch, e.g. a delete failed in an earlier pass
+	if opts.DeleteAfterArchive {
+		for _, item := range items {
+			rec := records[item.Name]
+			if item.Skipped != SkipArchived || removing[item.Name] || rec.Verification != VerificationVerified || rec.IndexRemoved {
+				continue
+			}
+			if opts.CloseInstead && item.Status == IndexStatusClosed {
+				continue
+			}
+			// the index may have changed since it was archived
+			if item.DocsCount != rec.DocsCount {
+				reason := fmt.Sprintf("archived %d docs, index has %d", rec.DocsCount, item.DocsCount)
+				log.With(Fields{"index": item.Name, "reason": reason}).Warn("Suspicious")
+				plan.Suspicious = append(plan.Suspicious, item.Name+": "+reason)
+				continue
+			}
+			kind := ActionDeleteIndex
+			if opts.CloseInstead {
+				kind = ActionCloseIndex
+			}
+			log.With(Fields{"index": item.Name, "error": rec.RemoveError}).Info("Found Archived Index")
+			plan.State = append(plan.State, fmt.Sprintf("archive/%s:%d", item.Name, item.DocsCount))
+			plan.Actions = append(plan.Actions, Action{Kind: kind, Index: item.Name, Name: item.Name, Record: recordOf(item.Name)})
+		}
+	}
+
+	for _, item := range items {
+		// suspicious archives of earlier passes, kept in elasticsearch until forced to reindex
+		if rec := records[item.Name]; item.Skipped == SkipSuspicious && !reported[item.Name] {
+			plan.Suspicious = append(plan.Suspicious, item.Name+": "+rec.Reason)
+		}
+	}
+
+	// retry failed notifications once their jobs are notified or gone
+	for _, rec := range sortLedgerRecords(records) {
+		if e := rec.PendingEvent; e != nil && (!jobs[e.Job] || notifiedJobs[e.Job]) {
+			log.With(Fields{"index": rec.Index, "job": e.Job, "error": rec.NotifyError}).Info("Found Pending Notification")
+			plan.Actions = append(plan.Actions, Action{Kind: ActionNotify, Index: rec.Index, Name: e.Job, Outcome: e.Outcome, Event: e, Pending: true, Record: recordOf(rec.Index)})
+		}
+	}
+
+	for _, rec := range records {
+		if rec.Quarantined {
+			plan.Quarantined = append(plan.Quarantined, rec.Index)
+		}
+		if rec.NotifyError != "" {
+			plan.NotifyFailures = append(plan.NotifyFailures, rec.Index+": "+rec.NotifyError)
+		}
+	}
+	sort.Strings(plan.Quarantined)
+	sort.Strings(plan.NotifyFailures)
+
+	sort.Strings(plan.State)
+
+	plan.Queue = candidateIndices
+
+	slots := opts.Tasks - jobCount
+	if slots < 0 {
+		slots = 0
+	}
+	plan.Slots = slots
+	log.With(Fields{"slots": slots}).Info("Remaining Slots")
+
+	sched := newScheduler(opts, slots, inFlight, inFlightByNode)
+	var scheduled []Candidate
+	for _, index := range candidateIndices {
+		if sched.full() {
+			break
+		}
+		c := byIndex[index]
+		if !sched.fit(&c) {
+			log.With(Fields{"index": index, "storage": formatBytes(c.Storage)}).Info("Deferred, storage does not fit")
+			plan.Deferred = append(plan.Deferred, index)
+			continue
+		}
+		scheduled = append(scheduled, c)
+	}
+
+	isScheduled := map[string]bool{}
+	for _, c := range scheduled {
+		isScheduled[c.Index] = true
+	}
+	for _, index := range candidateIndices {
+		if !isScheduled[index] {
+			plan.Backlog++
+			plan.BacklogBytes += byIndex[index].Size
+		}
+	}
+
+	for _, c := range scheduled {
+		taskName := taskNameFromIndex(c.Index)
+		var job *batchv1.Job
+		if job, err = r.buildJob(c); err != nil {
+			return
+		}
+		plan.Actions = append(plan.Actions,
+			Action{Kind: ActionCreatePVC, Index: c.Index, Name: taskName, PVC: r.buildPVC(c)},
+			Action{Kind: ActionCreateJob, Index: c.Index, Name: taskName, Job: job},
+			Action{Kind: ActionPatchPV, Index: c.Index, Name: taskName},
+		)
+	}
+
+	return
+}
+
+// CheckDrift recomputes the plan and returns error if the observed state changed since plan was computed
+func (r *Reconciler) CheckDrift(ctx context.Context, plan *Plan) (err error) {
+	if plan.Namespace != r.Options.Namespace {
+		err = fmt.Errorf("plan is for namespace %s, not %s", plan.Namespace, r.Options.Namespace)
+		return
+	}
+
+	var current *Plan
+	if current, err = r.Plan(ctx); err != nil {
+		return
+	}
+
+	added, removed := diffStrSlices(plan.State, current.State)
+	if len(added) == 0 && len(removed) == 0 {
+		return
+	}
+
+	var details []string
+	for _, item := range added {
+		details = append(details, "+"+item)
+	}
+	for _, item := range removed {
+		details = append(details, "-"+item)
+	}
+	err = fmt.Errorf("cluster state drifted since plan was computed at %s: %s", plan.CreatedAt.Format(time.RFC3339), strings.Join(details, ", "))
+	return
+}
+
+// Apply executes actions of the plan in order, in dry run mode actions are only logged
+func (r *Reconciler) Apply(ctx context.Context, plan *Plan) (res *Result, err error) {
+	res = &Result{
+		Candidates:  plan.Candidates,
+		Ongoing:     plan.Ongoing,
+		Slots:       plan.Slots,
+		Verified:    plan.Verified,
+		Suspicious:  plan.Suspicious,
+		Quarantined: plan.Quarantined,
+		Kept:        plan.Kept,
+	}
+
+	// a plan loaded from file has a copy of the record in each action, share them again by index
+	shared := map[string]*LedgerRecord{}
+	for i := range plan.Actions {
+		action := &plan.Actions[i]
+		if action.Record == nil || action.Kind == ActionRecord {
+			continue
+		}
+		if rec := shared[action.Index]; rec != nil {
+			action.Record = rec
+		} else {
+			shared[action.Index] = action.Record
+		}
+	}
+
+	// indices whose record failed to write, their tasks are kept so the next pass records them
+	unrecorded := map[string]bool{}
+
+	for _, action := range plan.Actions {
+		if unrecorded[action.Index] && action.cleansUpTask() {
+			r.log().With(action.Fields()).Warn("Skipped, task is not recorded")
+			continue
+		}
+		r.log().With(action.Fields()).Info("Action")
+		if err = r.applyAction(ctx, action, res); err != nil {
+			if action.Kind == ActionRecord {
+				r.log().WithError(err).With(action.Fields()).Error("Failed to record")
+				res.RecordFailures = append(res.RecordFailures, action.Index)
+				unrecorded[action.Index] = true
+				err = nil
+				continue
+			}
+			// the index is removed again by a later pass
+			if action.Kind == ActionDeleteIndex || action.Kind == ActionCloseIndex {
+				r.log().WithError(err).With(action.Fields()).Error("Failed to remove index")
+				res.RemoveFailures = append(res.RemoveFailures, action.Index)
+				err = nil
+				continue
+			}
+			err = fmt.Errorf("failed to %s: %s", action.String(), err.Error())
+			return
+		}
+	}
+	return
+}
+
+// cleansUpTask returns true if action removes a finished task or its index, that must not happen before the task is recorded
+func (a Action) cleansUpTask() bool {
+	switch a.Kind {
+	case ActionDeleteJob, ActionDeleteConfigMap, ActionDeleteIndex, ActionCloseIndex:
+		return true
+	case ActionDeletePVC, ActionDeletePod:
+		return a.Reason == ReasonFinished
+	}
+	return false
+}
+
+func (r *Reconciler) applyAction(ctx context.Context, action Action, res *Result) (err error) {
+	opts := r.Options
+
+	switch action.Kind {
+	case ActionDeletePVC:
+		if action.Reason == ReasonOrphan {
+			res.OrphanPVCs = append(res.OrphanPVCs, action.Name)
+		}
+		if opts.DryRun {
+			return
+		}
+		if err = r.Kube.CoreV1().PersistentVolumeClaims(opts.Namespace).Delete(ctx, action.Name, metav1.DeleteOptions{}); err != nil {
+			if action.Reason != ReasonFinished {
+				return
+			}
+			err = nil
+		}
+		if action.Reason == ReasonOrphan {
+			err = r.Sleep(ctx, time.Second*5)
+		} else {
+			err = r.Sleep(ctx, time.Second*10)
+		}
+	case ActionDeletePod:
+		res.DeletedPods = append(res.DeletedPods, action.Name)
+		if opts.DryRun {
+			return
+		}
+		err = r.Kube.CoreV1().Pods(opts.Namespace).Delete(ctx, action.Name, metav1.DeleteOptions{})
+	case ActionDeleteJob:
+		if action.Outcome == OutcomeComplete {
+			res.Completed = append(res.Completed, action.Name)
+		} else {
+			res.Failed = append(res.Failed, action.Name)
+		}
+		if opts.DryRun {
+			return
+		}
+		if !action.Notified {
+			r.notifyJob(ctx, action, res)
+		}
+		_ = r.Kube.BatchV1().Jobs(opts.Namespace).Delete(ctx, action.Name, metav1.DeleteOptions{})
+	case ActionNotify:
+		if opts.DryRun {
+			return
+		}
+		r.notifyJob(ctx, action, res)
+	case ActionCreatePVC:
+		r.log().With(pvcSummary(action.PVC)).Info("Create PVC")
+		if opts.DryRun {
+			return
+		}
+		_, err = r.Kube.CoreV1().PersistentVolumeClaims(opts.Namespace).Create(ctx, action.PVC, metav1.CreateOptions{})
+	case ActionCreateJob:
+		r.log().With(jobSummary(action.Job)).Info("Create Job")
+		res.Scheduled = append(res.Scheduled, action.Index)
+		if opts.DryRun {
+			return
+		}
+		_, err = r.Kube.BatchV1().Jobs(opts.Namespace).Create(ctx, action.Job, metav1.CreateOptions{})
+	case ActionRecord:
+		if opts.DryRun || action.Record == nil {
+			return
+		}
+		if err = r.ledger().Put(ctx, *action.Record); err != nil {
+			return
+		}
+		if r.Metrics != nil {
+			var retention *retentionPolicy
+			if retention, err = newRetentionPolicy(opts.Retention, opts.Days); err != nil {
+				return
+			}
+			r.Metrics.observeTask(retention.ruleFor(action.Index).Pattern, *action.Record)
+		}
+	case ActionDeleteConfigMap:
+		if opts.DryRun {
+			return
+		}
+		_ = r.Kube.CoreV1().ConfigMaps(opts.Namespace).Delete(ctx, action.Name, metav1.DeleteOptions{})
+	case ActionDeleteIndex, ActionCloseIndex:
+		err = r.removeIndex(ctx, action, res)
+	case ActionPatchPV:
+		if opts.DryRun {
+			return
+		}
+		err = r.patchPV(ctx, action.Name, res)
+	default:
+		err = fmt.Errorf("unknown action kind: %s", action.Kind)
+	}
+	return
+}
+
+// removeIndex deletes or closes the archived index, and records the outcome in ledger
+func (r *Reconciler) removeIndex(ctx context.Context, action Action, res *Result) (err error) {
+	if !r.Options.DryRun {
+		if action.Kind == ActionDeleteIndex {
+			err = r.Indices.DeleteIndex(ctx, action.Name)
+		} else {
+			err = r.Indices.CloseIndex(ctx, action.Name)
+		}
+	}
+	if err == nil {
+		if action.Kind == ActionDeleteIndex {
+			res.DeletedIndices = append(res.DeletedIndices, action.Name)
+		} else {
+			res.ClosedIndices = append(res.ClosedIndices, action.Name)
+		}
+	}
+	if r.Options.DryRun || action.Record == nil {
+		return
+	}
+	rec := action.Record
+	rec.IndexRemoved, rec.RemoveError = err == nil, ""
+	if err != nil {
+		rec.RemoveError = err.Error()
+	}
+	if perr := r.ledger().Put(ctx, *rec); perr != nil {
+		r.log().WithError(perr).With(action.Fields()).Warn("Failed to record removal")
+	}
+	return
+}
+
+// patchPV waits for pvc to bind, and set reclaim policy of the pv to retain
+func (r *Reconciler) patchPV(ctx context.Context, pvcName string, res *Result) (err error) {
+	opts := r.Options
+
+	if err = r.Sleep(ctx, time.Second*10); err != nil {
+		return
+	}
+
+	var pvc *corev1.PersistentVolumeClaim
+	if pvc, err = r.Kube.CoreV1().PersistentVolumeClaims(opts.Namespace).Get(ctx, pvcName, metav1.GetOptions{}); err != nil {
+		return
+	}
+
+	if pvc.Spec.VolumeName == "" {
+		err = fmt.Errorf("failed to locate pv name for pvc: %s", pvcName)
+		return
+	}
+
+	var pv *corev1.PersistentVolume
+	if pv, err = r.Kube.CoreV1().PersistentVolumes().Get(ctx, pvc.Spec.VolumeName, metav1.GetOptions{}); err != nil {
+		return
+	}
+
+	r.log().With(Fields{"action": string(ActionPatchPV), "pvc": pvcName, "pv": pv.Name}).Info("PV Patch")
+	if _, err = r.Kube.CoreV1().PersistentVolumes().Patch(ctx, pv.Name, types.StrategicMergePatchType, []byte(PatchRetain), metav1.PatchOptions{}); err != nil {
+		return
+	}
+
+	res.PatchedPVs = append(res.PatchedPVs, pv.Name)
+	return
+}
+
+// notifyJob notifies outcome of job in action and marks the job notified, unless no notifier delivered it
+func (r *Reconciler) notifyJob(ctx context.Context, action Action, res *Result) {
+	event := Event{Index: action.Index, Job: action.Name, Outcome: action.Outcome}
+	if action.Event != nil {
+		event = *action.Event
+	}
+	var only []string
+	if action.Pending && action.Record != nil {
+		only = action.Record.FailedNotifiers
+	}
+	failed, delivered, err := r.notify(ctx, event, only, res)
+	if (err == nil || delivered) && !action.Pending {
+		r.markNotified(ctx, action.Name)
+	}
+	r.recordNotify(ctx, action, event, failed, delivered, err)
+}
+
+// recordNotify keeps failed notifications in ledger for later passes to retry.
+func (r *Reconciler) recordNotify(ctx context.Context, action Action, event Event, failed []string, delivered bool, err error) {
+	rec := action.Record
+	if rec == nil {
+		return
+	}
+	switch {
+	case err != nil:
+		rec.NotifyError = err.Error()
+		// an unnotified kept job is notified again as is
+		if action.Kind == ActionDeleteJob || action.Pending || delivered {
+			event.Diagnostics = event.Diagnostics.ledgerSummary()
+			rec.PendingEvent, rec.FailedNotifiers = &event, failed
+		}
+	case action.Pending:
+		rec.NotifyError, rec.PendingEvent, rec.FailedNotifiers = "", nil, nil
+	case rec.NotifyError != "" && rec.PendingEvent == nil:
+		rec.NotifyError = ""
+	default:
+		return
+	}
+	if perr := r.ledger().Put(ctx, *rec); perr != nil {
+		r.log().WithError(perr).With(action.Fields()).Warn("Failed to record notification")
+	}
+}
+
+// keepFailedUntil returns the time a failed job is kept until, zero if job is not failed or not kept
+func (r *Reconciler) keepFailedUntil(job batchv1.Job, outcome string) time.Time {
+	if outcome != OutcomeFailed || r.Options.KeepFailed.Duration <= 0 {
+		return time.Time{}
+	}
+	finishedAt := jobFinishedAt(job)
+	if finishedAt.IsZero() {
+		finishedAt = job.CreationTimestamp.Time
+	}
+	return finishedAt.Add(r.Options.KeepFailed.Duration)
+}
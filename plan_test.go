@@ -0,0 +1,126 @@
+package main
+
+import (
+	"context"
+	batchv1 "k8s.io/api/batch/v1"
+	"reflect"
+	"sigs.k8s.io/yaml"
+	"strings"
+	"testing"
+)
+
+func TestPlanApplyRoundTrip(t *testing.T) {
+	opts := testOptions()
+	// retry failed index right away
+	opts.RetryBackoff.Duration = 0
+	r, kube := newTestReconciler(t, opts, []map[string]string{
+		{"index": "a-2021-01-01"},
+		{"index": "b-2021-01-01"},
+	})
+	kube.Add(finishedJob("b-2021-01-01", batchv1.JobFailed))
+
+	plan, err := r.Plan(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var kinds []string
+	for _, action := range plan.Actions {
+		kinds = append(kinds, string(action.Kind)+" "+action.Name)
+	}
+	want := []string{
+		"record b-2021-01-01",
+		"delete-job task-b-2021-01-01",
+		"create-pvc task-a-2021-01-01",
+		"create-job task-a-2021-01-01",
+		"patch-pv task-a-2021-01-01",
+		"create-pvc task-b-2021-01-01",
+		"create-job task-b-2021-01-01",
+		"patch-pv task-b-2021-01-01",
+	}
+	if !reflect.DeepEqual(kinds, want) {
+		t.Fatalf("actions = %v, want %v", kinds, want)
+	}
+
+	buf, err := yaml.Marshal(plan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded := &Plan{}
+	if err = yaml.Unmarshal(buf, loaded); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = r.CheckDrift(context.Background(), loaded); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = r.Apply(context.Background(), loaded); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"task-a-2021-01-01", "task-b-2021-01-01"}; !reflect.DeepEqual(kube.Names("jobs"), want) {
+		t.Fatalf("jobs = %v, want %v", kube.Names("jobs"), want)
+	}
+	job := &batchv1.Job{}
+	kube.Get(job, testNamespace, "task-b-2021-01-01")
+	if len(job.Status.Conditions) != 0 {
+		t.Fatal("failed job should be replaced by a new one")
+	}
+}
+
+func TestPlanDrift(t *testing.T) {
+	r, kube := newTestReconciler(t, testOptions(), []map[string]string{
+		{"index": "a-2021-01-01"},
+	})
+
+	plan, err := r.Plan(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	kube.Add(&batchv1.Job{ObjectMeta: taskObjectMeta("task-a-2021-01-01", "a-2021-01-01")})
+
+	err = r.CheckDrift(context.Background(), plan)
+	if err == nil || !strings.Contains(err.Error(), "+job/task-a-2021-01-01") {
+		t.Fatalf("expected drift error, got %v", err)
+	}
+}
+
+func TestPlanApplyRoundTripKeepsNotifyFailure(t *testing.T) {
+	hook := newFakeHook(t, 1)
+
+	opts := testOptions()
+	opts.Tasks = 0
+	opts.NotifyRetries = 0
+	opts.NotifyURL = hook.URL
+	opts.DeleteAfterArchive = true
+	r, kube := newTestReconciler(t, opts, []map[string]string{
+		{"index": "a-2021-01-01", "docs.count": "42"},
+	})
+	kube.Add(finishedJob("a-2021-01-01", batchv1.JobComplete))
+	kube.Add(succeededPod("a-2021-01-01", testManifest))
+
+	plan, err := r.Plan(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf, err := yaml.Marshal(plan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	loaded := &Plan{}
+	if err = yaml.Unmarshal(buf, loaded); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = r.Apply(context.Background(), loaded); err != nil {
+		t.Fatal(err)
+	}
+
+	// removal of the index puts the record after the failed notification, and keeps it
+	records, err := r.ledger().Load(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec := records["a-2021-01-01"]; !rec.IndexRemoved || rec.NotifyError == "" || rec.PendingEvent == nil {
+		t.Fatalf("record = %+v", rec)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// loadPodTemplateFile loads a partial pod template spec from yaml file, a full PodTemplate object is unwrapped
+func loadPodTemplateFile(file string) (tmpl map[string]interface{}, err error) {
+	var buf []byte
+	if buf, err = ioutil.ReadFile(file); err != nil {
+		return
+	}
+	if err = yaml.Unmarshal(buf, &tmpl); err != nil {
+		return
+	}
+	if tmpl["kind"] == "PodTemplate" {
+		inner, ok := tmpl["template"].(map[string]interface{})
+		if !ok {
+			err = fmt.Errorf("PodTemplate in %s has no template", file)
+			return
+		}
+		tmpl = inner
+	}
+	return
+}
+
+// mergePodTemplate merges patches onto pod template in order, see mergeValue
+func mergePodTemplate(tmpl *corev1.PodTemplateSpec, patches ...map[string]interface{}) (err error) {
+	var buf []byte
+	if buf, err = json.Marshal(tmpl); err != nil {
+		return
+	}
+	var merged interface{}
+	if err = json.Unmarshal(buf, &merged); err != nil {
+		return
+	}
+	for _, patch := range patches {
+		if patch != nil {
+			merged = mergeValue(merged, patch)
+		}
+	}
+	if buf, err = json.Marshal(merged); err != nil {
+		return
+	}
+
+	out := corev1.PodTemplateSpec{}
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	dec.DisallowUnknownFields()
+	if err = dec.Decode(&out); err != nil {
+		return
+	}
+	*tmpl = out
+	return
+}
+
+// validatePodTemplate checks patches are valid partial pod template specs
+func validatePodTemplate(patches ...map[string]interface{}) error {
+	return mergePodTemplate(&corev1.PodTemplateSpec{}, patches...)
+}
+
+// mergeValue merges patch onto base: maps are merged recursively and null removes a key,
+// lists of named objects (containers, volumes, env, ...) are merged by name, unnamed items by position,
+// anything else is replaced
+func mergeValue(base, patch interface{}) interface{} {
+	switch patch := patch.(type) {
+	case map[string]interface{}:
+		baseMap, ok := base.(map[string]interface{})
+		if !ok {
+			baseMap = map[string]interface{}{}
+		}
+		out := map[string]interface{}{}
+		for k, v := range baseMap {
+			out[k] = v
+		}
+		for k, v := range patch {
+			if v == nil {
+				delete(out, k)
+			} else {
+				out[k] = mergeValue(out[k], v)
+			}
+		}
+		return out
+	case []interface{}:
+		baseList, ok := base.([]interface{})
+		if !ok || !isNamedList(baseList) {
+			return patch
+		}
+		return mergeNamedList(baseList, patch)
+	default:
+		return patch
+	}
+}
+
+func itemName(item interface{}) (name string, ok bool) {
+	m, isMap := item.(map[string]interface{})
+	if !isMap {
+		return
+	}
+	name, ok = m["name"].(string)
+	return
+}
+
+func isNamedList(list []interface{}) bool {
+	if len(list) == 0 {
+		return false
+	}
+	for _, item := range list {
+		if _, ok := itemName(item); !ok {
+			return false
+		}
+	}
+	return true
+}
+
+func mergeNamedList(base, patch []interface{}) []interface{} {
+	out := append([]interface{}{}, base...)
+	for i, item := range patch {
+		if _, isMap := item.(map[string]interface{}); !isMap {
+			return patch
+		}
+		j := -1
+		if name, ok := itemName(item); ok {
+			for k := range out {
+				if outName, _ := itemName(out[k]); outName == name {
+					j = k
+					break
+				}
+			}
+		} else if i < len(base) {
+			j = i
+		}
+		if j < 0 {
+			out = append(out, item)
+		} else {
+			out[j] = mergeValue(out[j], item)
+		}
+	}
+	return out
+}
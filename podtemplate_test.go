@@ -0,0 +1,113 @@
+package main
+
+import (
+	"reflect"
+	"sigs.k8s.io/yaml"
+	"strings"
+	"testing"
+)
+
+func TestBuildJobMergesPodTemplate(t *testing.T) {
+	file := writeTestConfig(t, `
+kind: PodTemplate
+apiVersion: v1
+template:
+  spec:
+    nodeSelector:
+      storage: local
+    tolerations:
+    - key: dedicated
+      operator: Equal
+      value: storage
+      effect: NoSchedule
+`)
+	cfg, err := LoadConfig("test", []string{"--pod-template", file, "--config", writeTestConfig(t, `
+podTemplate:
+  metadata:
+    annotations:
+      tke.cloud.tencent.com/vpc-ip-claim-delete-policy: null
+  spec:
+    priorityClassName: low
+    serviceAccountName: esbridge
+    securityContext:
+      runAsNonRoot: true
+    containers:
+    - securityContext:
+        allowPrivilegeEscalation: false
+      resources:
+        requests:
+          cpu: 500m
+      env:
+      - name: ESBRIDGE_BATCH_SIZE
+        value: "500"
+      - name: EXTRA
+        value: "1"
+    volumes:
+    - name: vol-tmp
+      emptyDir: {}
+`)}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c := Candidate{Index: "a-2021-01-01", Node: "node-1"}
+	job, err := NewReconciler(cfg.Options, nil, nil).buildJob(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := job.Spec.Template
+	if want := map[string]string{indexAnnotationKey: "a-2021-01-01"}; !reflect.DeepEqual(tmpl.Annotations, want) {
+		t.Errorf("annotations = %v, want %v", tmpl.Annotations, want)
+	}
+	spec := tmpl.Spec
+	if want := map[string]string{hostnameLabelKey: "node-1", "storage": "local"}; !reflect.DeepEqual(spec.NodeSelector, want) {
+		t.Errorf("node selector = %v, want %v", spec.NodeSelector, want)
+	}
+	if len(spec.Tolerations) != 1 || spec.Tolerations[0].Key != "dedicated" {
+		t.Errorf("tolerations = %v", spec.Tolerations)
+	}
+	if spec.PriorityClassName != "low" || spec.ServiceAccountName != "esbridge" || spec.SecurityContext.RunAsNonRoot == nil {
+		t.Errorf("spec = %+v", spec)
+	}
+	if len(spec.Containers) != 1 {
+		t.Fatalf("containers = %+v", spec.Containers)
+	}
+	container := spec.Containers[0]
+	if container.Name != taskNameFromIndex(c.Index) || container.Image != "guoyk/esbridge" || container.SecurityContext == nil {
+		t.Errorf("container = %+v", container)
+	}
+	if cpu, mem := container.Resources.Requests.Cpu().String(), container.Resources.Requests.Memory().String(); cpu != "500m" || mem != "2000Mi" {
+		t.Errorf("requests = %s, %s", cpu, mem)
+	}
+	var env []string
+	for _, e := range container.Env {
+		env = append(env, e.Name+"="+e.Value)
+	}
+	if want := "ESBRIDGE_INDEX=a-2021-01-01,ESBRIDGE_BATCH_SIZE=500,ESBRIDGE_RESULT_CONFIGMAP=task-a-2021-01-01-result,EXTRA=1"; strings.Join(env, ",") != want {
+		t.Errorf("env = %v, want %s", env, want)
+	}
+	if len(spec.Volumes) != 3 || spec.Volumes[2].Name != "vol-tmp" || spec.Volumes[1].PersistentVolumeClaim.ClaimName != "task-a-2021-01-01" {
+		t.Errorf("volumes = %+v", spec.Volumes)
+	}
+}
+
+func TestMergeValue(t *testing.T) {
+	var base, patch interface{}
+	_ = yaml.Unmarshal([]byte(`{a: {b: 1, c: 2}, args: [x, y], items: [{name: p, v: 1}, {name: q, v: 2}]}`), &base)
+	// unnamed items merge by position, named by name, unknown names are appended
+	_ = yaml.Unmarshal([]byte(`{a: {c: null, d: 3}, args: [z], items: [{v: 4}, {name: q, v: 3}, {name: r}]}`), &patch)
+	var want interface{}
+	_ = yaml.Unmarshal([]byte(`{a: {b: 1, d: 3}, args: [z], items: [{name: p, v: 4}, {name: q, v: 3}, {name: r}]}`), &want)
+	if got := mergeValue(base, patch); !reflect.DeepEqual(got, want) {
+		t.Errorf("merged = %v, want %v", got, want)
+	}
+}
+
+func TestValidatePodTemplate(t *testing.T) {
+	if err := validatePodTemplate(map[string]interface{}{"spec": map[string]interface{}{"nodeSelectr": map[string]interface{}{}}}); err == nil {
+		t.Error("expected error for unknown field")
+	}
+	if err := validatePodTemplate(nil, map[string]interface{}{"spec": map[string]interface{}{"priorityClassName": "low"}}); err != nil {
+		t.Error(err)
+	}
+}
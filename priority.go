@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	TieBreakerOldestFirst   = "oldest-first"
+	TieBreakerLargestFirst  = "largest-first"
+	TieBreakerSmallestFirst = "smallest-first"
+)
+
+// PriorityGroup weights indices matching Pattern, candidates with lower weight are scheduled first,
+// see compileIndexPattern for pattern syntax
+type PriorityGroup struct {
+	Pattern string `json:"pattern"`
+	Weight  int    `json:"weight"`
+}
+
+func (g PriorityGroup) String() string {
+	return fmt.Sprintf("%s=%d", g.Pattern, g.Weight)
+}
+
+// priorityPolicy orders candidates by weight of first matching group, unmatched indices weigh 0,
+// then by tie breaker, then by date and name
+type priorityPolicy struct {
+	groups     []PriorityGroup
+	matchers   []indexMatcher
+	tieBreaker string
+}
+
+func newPriorityPolicy(groups []PriorityGroup, tieBreaker string) (p *priorityPolicy, err error) {
+	switch tieBreaker {
+	case TieBreakerOldestFirst, TieBreakerLargestFirst, TieBreakerSmallestFirst:
+	default:
+		err = fmt.Errorf("unknown tie breaker %s, should be one of oldest-first, largest-first, smallest-first", tieBreaker)
+		return
+	}
+	p = &priorityPolicy{groups: groups, tieBreaker: tieBreaker}
+	for _, group := range groups {
+		var m indexMatcher
+		if m, err = compileIndexPattern(group.Pattern); err != nil {
+			return
+		}
+		p.matchers = append(p.matchers, m)
+	}
+	return
+}
+
+func (p *priorityPolicy) weightOf(index string) int {
+	for i, m := range p.matchers {
+		if m(index) {
+			return p.groups[i].Weight
+		}
+	}
+	return 0
+}
+
+// sort sorts candidates in scheduling order
+func (p *priorityPolicy) sort(candidates []Candidate) {
+	weights := map[string]int{}
+	for _, c := range candidates {
+		weights[c.Index] = p.weightOf(c.Index)
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := candidates[i], candidates[j]
+		if weights[a.Index] != weights[b.Index] {
+			return weights[a.Index] < weights[b.Index]
+		}
+		if a.Size != b.Size {
+			switch p.tieBreaker {
+			case TieBreakerLargestFirst:
+				return a.Size > b.Size
+			case TieBreakerSmallestFirst:
+				return a.Size < b.Size
+			}
+		}
+		if !a.Date.Equal(b.Date) {
+			return a.Date.Before(b.Date)
+		}
+		return a.Index < b.Index
+	})
+}
+
+// priorityGroups is a flag.Value for comma separated groups like "info-prod-*=50,*-prod*=10"
+type priorityGroups []PriorityGroup
+
+func (l *priorityGroups) String() string {
+	var items []string
+	for _, group := range *l {
+		items = append(items, group.String())
+	}
+	return strings.Join(items, ",")
+}
+
+func (l *priorityGroups) Set(s string) (err error) {
+	*l = nil
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		i := strings.LastIndex(item, "=")
+		if i < 0 {
+			return fmt.Errorf("invalid priority group %s, should be PATTERN=WEIGHT", item)
+		}
+		var weight int
+		if weight, err = strconv.Atoi(item[i+1:]); err != nil {
+			return fmt.Errorf("invalid priority group %s, should be PATTERN=WEIGHT", item)
+		}
+		*l = append(*l, PriorityGroup{Pattern: item[:i], Weight: weight})
+	}
+	return
+}
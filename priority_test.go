@@ -0,0 +1,81 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func sortedIndices(t *testing.T, groups []PriorityGroup, tieBreaker string, candidates []Candidate) []string {
+	p, err := newPriorityPolicy(groups, tieBreaker)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.sort(candidates)
+	var out []string
+	for _, c := range candidates {
+		out = append(out, c.Index)
+	}
+	return out
+}
+
+func TestPrioritySortDefault(t *testing.T) {
+	var candidates []Candidate
+	for _, index := range []string{
+		"info-prod-2021-03-02",
+		"info-prod-2021-03-01",
+		"access-prod-2021-03-02",
+		"access-prod-2021-03-01",
+		"warn-prod-2021-03-02",
+		"warn-prod-2021-03-01",
+		"access-test-2021-03-02",
+		"access-test-2021-03-01",
+	} {
+		date, _ := time.Parse("2006-01-02", index[len(index)-10:])
+		candidates = append(candidates, Candidate{Index: index, Date: date})
+	}
+	cfg := DefaultConfig()
+	want := []string{
+		"access-test-2021-03-01",
+		"access-test-2021-03-02",
+		"warn-prod-2021-03-01",
+		"warn-prod-2021-03-02",
+		"access-prod-2021-03-01",
+		"access-prod-2021-03-02",
+		"info-prod-2021-03-01",
+		"info-prod-2021-03-02",
+	}
+	if got := sortedIndices(t, cfg.Priority, cfg.TieBreaker, candidates); !reflect.DeepEqual(got, want) {
+		t.Fatalf("sorted = %v, want %v", got, want)
+	}
+}
+
+func TestPrioritySortTieBreakers(t *testing.T) {
+	day := func(d int) time.Time {
+		return time.Date(2021, 3, d, 0, 0, 0, 0, time.UTC)
+	}
+	candidates := func() []Candidate {
+		return []Candidate{
+			{Index: "weekly-2021w09", Date: day(1), Size: 100},
+			{Index: "small-2021-03-02", Date: day(2), Size: 10},
+			{Index: "big-2021-03-03", Date: day(3), Size: 1000},
+			{Index: "big-2021-03-01", Date: day(1), Size: 1000},
+			{Index: "urgent-2021-03-09", Date: day(9), Size: 1},
+		}
+	}
+	groups := []PriorityGroup{{Pattern: "urgent-*", Weight: -1}}
+
+	for tieBreaker, want := range map[string][]string{
+		TieBreakerOldestFirst:   {"urgent-2021-03-09", "big-2021-03-01", "weekly-2021w09", "small-2021-03-02", "big-2021-03-03"},
+		TieBreakerLargestFirst:  {"urgent-2021-03-09", "big-2021-03-01", "big-2021-03-03", "weekly-2021w09", "small-2021-03-02"},
+		TieBreakerSmallestFirst: {"urgent-2021-03-09", "small-2021-03-02", "weekly-2021w09", "big-2021-03-01", "big-2021-03-03"},
+	} {
+		if got := sortedIndices(t, groups, tieBreaker, candidates()); !reflect.DeepEqual(got, want) {
+			t.Errorf("%s: sorted = %v, want %v", tieBreaker, got, want)
+		}
+	}
+
+	if _, err := newPriorityPolicy(nil, "random"); err == nil {
+		t.Error("expected error for unknown tie breaker")
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"strings"
+)
+
+// JobProfile overrides task settings of indices it selects, a profile selects indices matching Pattern
+// with primary store size at least MinSize and below MaxSize, empty criteria match any index
+type JobProfile struct {
+	Name    string `json:"name"`
+	Pattern string `json:"pattern"`
+	MinSize string `json:"minSize"`
+	MaxSize string `json:"maxSize"`
+	// Resources override resources of task container by resource name
+	Resources corev1.ResourceRequirements `json:"resources"`
+	Batch     string                      `json:"batch"`
+	// Env is added to task container after Env of options, values are templates of EnvData
+	Env []corev1.EnvVar `json:"env"`
+	// ImageTag replaces tag of image
+	ImageTag     string `json:"imageTag"`
+	StorageClass string `json:"storageClass"`
+}
+
+// profilePolicy selects the first matching profile of an index
+type profilePolicy struct {
+	profiles []JobProfile
+	matchers []indexMatcher
+	minSizes []int64
+	maxSizes []int64
+}
+
+func newProfilePolicy(profiles []JobProfile) (p *profilePolicy, err error) {
+	p = &profilePolicy{profiles: profiles}
+	names := map[string]bool{}
+	for _, profile := range profiles {
+		if profile.Name == "" {
+			err = errors.New("profile name is required")
+			return
+		}
+		if names[profile.Name] {
+			err = fmt.Errorf("duplicated profile %s", profile.Name)
+			return
+		}
+		names[profile.Name] = true
+
+		m := func(string) bool { return true }
+		if profile.Pattern != "" {
+			if m, err = compileIndexPattern(profile.Pattern); err != nil {
+				return
+			}
+		}
+		var minSize, maxSize int64
+		if minSize, err = parseProfileSize(profile.MinSize); err != nil {
+			err = fmt.Errorf("invalid minSize of profile %s: %s", profile.Name, err.Error())
+			return
+		}
+		if maxSize, err = parseProfileSize(profile.MaxSize); err != nil {
+			err = fmt.Errorf("invalid maxSize of profile %s: %s", profile.Name, err.Error())
+			return
+		}
+		p.matchers = append(p.matchers, m)
+		p.minSizes = append(p.minSizes, minSize)
+		p.maxSizes = append(p.maxSizes, maxSize)
+	}
+	return
+}
+
+// parseProfileSize parses a quantity in bytes, empty is 0
+func parseProfileSize(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	q, err := resource.ParseQuantity(s)
+	if err != nil {
+		return 0, err
+	}
+	return q.Value(), nil
+}
+
+// profileOf returns name of first profile selecting index of size bytes, empty if none
+func (p *profilePolicy) profileOf(index string, size int64) string {
+	for i, m := range p.matchers {
+		if !m(index) || size < p.minSizes[i] || (p.maxSizes[i] > 0 && size >= p.maxSizes[i]) {
+			continue
+		}
+		return p.profiles[i].Name
+	}
+	return ""
+}
+
+// findProfile returns profile of name, nil if name is empty or not found
+func findProfile(profiles []JobProfile, name string) *JobProfile {
+	if name == "" {
+		return nil
+	}
+	for i := range profiles {
+		if profiles[i].Name == name {
+			return &profiles[i]
+		}
+	}
+	return nil
+}
+
+// apply overrides image, resources and batch of task container with the profile, env is rendered by buildJob
+func (profile *JobProfile) apply(container *corev1.Container) {
+	if profile.ImageTag != "" {
+		container.Image = imageWithTag(container.Image, profile.ImageTag)
+	}
+	for name, quantity := range profile.Resources.Requests {
+		if container.Resources.Requests == nil {
+			container.Resources.Requests = corev1.ResourceList{}
+		}
+		container.Resources.Requests[name] = quantity
+	}
+	for name, quantity := range profile.Resources.Limits {
+		if container.Resources.Limits == nil {
+			container.Resources.Limits = corev1.ResourceList{}
+		}
+		container.Resources.Limits[name] = quantity
+	}
+	if profile.Batch != "" {
+		setEnv(container, corev1.EnvVar{Name: "ESBRIDGE_BATCH_SIZE", Value: profile.Batch})
+	}
+}
+
+// setEnv replaces variable of the same name in container, or appends it
+func setEnv(container *corev1.Container, env corev1.EnvVar) {
+	for i := range container.Env {
+		if container.Env[i].Name == env.Name {
+			container.Env[i] = env
+			return
+		}
+	}
+	container.Env = append(container.Env, env)
+}
+
+// imageWithTag replaces tag or digest of image, a registry port is not a tag
+func imageWithTag(image, tag string) string {
+	if i := strings.Index(image, "@"); i >= 0 {
+		image = image[:i]
+	}
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		image = image[:i]
+	}
+	return image + ":" + tag
+}
@@ -0,0 +1,103 @@
+package main
+
+import (
+	"context"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"strconv"
+	"testing"
+)
+
+func TestReconcilerAppliesProfiles(t *testing.T) {
+	opts := testOptions()
+	opts.Tasks = 3
+	opts.Profiles = []JobProfile{
+		{
+			Name:    "huge",
+			Pattern: "access-prod-*",
+			MinSize: "10Gi",
+			Resources: corev1.ResourceRequirements{
+				Limits: corev1.ResourceList{corev1.ResourceMemory: resource.MustParse("12Gi")},
+			},
+			Batch:        "500",
+			Env:          []corev1.EnvVar{{Name: "ESBRIDGE_SCROLL", Value: "5m"}},
+			ImageTag:     "v2",
+			StorageClass: "fast",
+		},
+		{
+			Name:    "tiny",
+			MaxSize: "1Gi",
+			Resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{corev1.ResourceCPU: resource.MustParse("500m")},
+			},
+		},
+	}
+	r, kube := newTestReconciler(t, opts, []map[string]string{
+		{"index": "access-prod-2021-01-01", "pri.store.size": strconv.Itoa(testGi * 20)},
+		{"index": "access-prod-2021-01-02", "pri.store.size": strconv.Itoa(testGi * 2)},
+		{"index": "debug-2021-01-01", "pri.store.size": strconv.Itoa(testGi / 2)},
+	})
+
+	if _, err := r.Reconcile(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	job := &batchv1.Job{}
+	kube.Get(job, testNamespace, "task-access-prod-2021-01-01")
+	if job.Annotations[profileAnnotationKey] != "huge" {
+		t.Fatalf("job annotations = %v", job.Annotations)
+	}
+	container := job.Spec.Template.Spec.Containers[0]
+	if container.Image != "guoyk/esbridge:v2" || container.Resources.Limits.Memory().String() != "12Gi" || container.Resources.Limits.Cpu().String() != "2" {
+		t.Errorf("container = %+v", container)
+	}
+	if env := container.Env; len(env) != 4 || env[1].Value != "500" || env[3].Name != "ESBRIDGE_SCROLL" {
+		t.Errorf("env = %v", env)
+	}
+	pvc := &corev1.PersistentVolumeClaim{}
+	kube.Get(pvc, testNamespace, "task-access-prod-2021-01-01")
+	if *pvc.Spec.StorageClassName != "fast" {
+		t.Errorf("storage class = %s", *pvc.Spec.StorageClassName)
+	}
+
+	// too small for huge, too large for tiny
+	job = &batchv1.Job{}
+	kube.Get(job, testNamespace, "task-access-prod-2021-01-02")
+	if _, ok := job.Annotations[profileAnnotationKey]; ok || job.Spec.Template.Spec.Containers[0].Image != "guoyk/esbridge" {
+		t.Errorf("job = %+v", job)
+	}
+
+	job = &batchv1.Job{}
+	kube.Get(job, testNamespace, "task-debug-2021-01-01")
+	if job.Annotations[profileAnnotationKey] != "tiny" || job.Spec.Template.Spec.Containers[0].Resources.Requests.Cpu().String() != "500m" {
+		t.Errorf("job = %+v", job)
+	}
+}
+
+func TestImageWithTag(t *testing.T) {
+	for image, want := range map[string]string{
+		"guoyk/esbridge":                      "guoyk/esbridge:v2",
+		"guoyk/esbridge:latest":               "guoyk/esbridge:v2",
+		"registry:5000/guoyk/esbridge":        "registry:5000/guoyk/esbridge:v2",
+		"registry:5000/guoyk/esbridge:v1":     "registry:5000/guoyk/esbridge:v2",
+		"guoyk/esbridge:v1@sha256:0123abcdef": "guoyk/esbridge:v2",
+	} {
+		if got := imageWithTag(image, "v2"); got != want {
+			t.Errorf("imageWithTag(%s) = %s, want %s", image, got, want)
+		}
+	}
+}
+
+func TestNewProfilePolicyInvalid(t *testing.T) {
+	for _, profiles := range [][]JobProfile{
+		{{Pattern: "a-*"}},
+		{{Name: "a"}, {Name: "a"}},
+		{{Name: "a", MinSize: "lots"}},
+		{{Name: "a", Pattern: "/[/"}},
+	} {
+		if _, err := newProfilePolicy(profiles); err == nil {
+			t.Errorf("expected error for %+v", profiles)
+		}
+	}
+}
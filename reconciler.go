@@ -0,0 +1,434 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"math"
+	"strconv"
+	"time"
+)
+
+// Options controls how tasks are selected and created
+type Options struct {
+	DryRun    bool   `json:"dryRun"`
+	Namespace string `json:"namespace"`
+	Tasks     int    `json:"tasks"`
+	Days      int    `json:"days"`
+	// Retention overrides Days for indices matching patterns
+	Retention []RetentionRule `json:"retention"`
+	// DatePatterns extract dates from index names, first match wins
+	DatePatterns []DatePattern `json:"datePatterns"`
+	// Timezone index dates are interpreted in, IANA name or Local
+	Timezone string `json:"timezone"`
+	// AgeSources are tried in order to date an index, from name, creation and timestamp
+	AgeSources []string `json:"ageSources"`
+	// TimestampField is the date field aggregated by timestamp age source
+	TimestampField string `json:"timestampField"`
+	// ClosedIndices and RedIndices are policies for unhealthy indices, skip, include or fail
+	ClosedIndices string `json:"closedIndices"`
+	RedIndices    string `json:"redIndices"`
+	ConfigMap     string `json:"configMap"`
+	ConfigMapKey  string `json:"configMapKey"`
+	StorageClass  string `json:"storageClass"`
+	// StorageRequest is the fixed pvc size, used when StorageFactor is zero
+	StorageRequest string `json:"storageRequest"`
+	// StorageFactor multiplies primary store size of index into pvc size, clamped to StorageMin and StorageMax
+	StorageFactor float64 `json:"storageFactor"`
+	StorageMin    string  `json:"storageMin"`
+	StorageMax    string  `json:"storageMax"`
+	// StorageBudget limits total storage of ongoing tasks, empty for unlimited
+	StorageBudget string `json:"storageBudget"`
+	// NodeBudgets limits storage of ongoing tasks per node, tasks are pinned to nodes if set
+	NodeBudgets     map[string]string `json:"nodeBudgets"`
+	Image           string            `json:"image"`
+	ImagePullPolicy corev1.PullPolicy `json:"imagePullPolicy"`
+	DataMount       string            `json:"dataMount"`
+	// NotifyURL is a legacy webhook receiving {"text": "..."}
+	NotifyURL string `json:"notifyURL"`
+	// Notifiers are notification backends of task outcomes
+	Notifiers []NotifierConfig `json:"notifiers"`
+	// NotifyRetries is retries of a failed delivery, in exponential backoff from 1s
+	NotifyRetries int `json:"notifyRetries"`
+	// NotifyLogLines is lines of pod logs tail in notifications
+	NotifyLogLines int `json:"notifyLogLines"`
+	// FailedLogLines is lines of pod logs tail collected from a failed task into the ledger
+	FailedLogLines int `json:"failedLogLines"`
+	// KeepFailed keeps failed jobs and their pvc for inspection, their indices are not scheduled meanwhile
+	KeepFailed metav1.Duration             `json:"keepFailed"`
+	Batch      string                      `json:"batch"`
+	Ignores    []string                    `json:"ignores"`
+	Resources  corev1.ResourceRequirements `json:"resources"`
+	// Env is added to task container, values are templates of EnvData
+	Env []corev1.EnvVar `json:"env"`
+	// EnvFromSecrets and EnvFromConfigMaps are names of secrets and configmaps exposed as env of task container
+	EnvFromSecrets    []string `json:"envFromSecrets"`
+	EnvFromConfigMaps []string `json:"envFromConfigMaps"`
+	// Ledger is the configmap recording archive history of indices
+	Ledger string `json:"ledger"`
+	// RetryBackoff is the delay before retrying an index after a failed task, doubled on each consecutive failure
+	RetryBackoff metav1.Duration `json:"retryBackoff"`
+	// RetryBackoffMax caps RetryBackoff
+	RetryBackoffMax metav1.Duration `json:"retryBackoffMax"`
+	// MaxAttempts is consecutive failed tasks before an index is quarantined, 0 for unlimited
+	MaxAttempts int `json:"maxAttempts"`
+	// ForceReindex are patterns of indices archived again even if the ledger records a completed archive
+	ForceReindex []string `json:"forceReindex"`
+	// DeleteAfterArchive deletes index after its task completed and the archive is verified
+	DeleteAfterArchive bool `json:"deleteAfterArchive"`
+	// CloseInstead closes index instead of deleting it
+	CloseInstead bool `json:"closeInstead"`
+	// PodAnnotations are added to pod template of job, empty values are skipped
+	PodAnnotations map[string]string `json:"podAnnotations"`
+	// PodTemplateFile is a yaml file of partial pod template spec, or a PodTemplate object, merged onto pod template of job
+	PodTemplateFile string `json:"podTemplateFile"`
+	// PodTemplate is a partial pod template spec merged onto pod template of job after PodTemplateFile
+	PodTemplate map[string]interface{} `json:"podTemplate"`
+	// filePodTemplate is the content of PodTemplateFile, loaded by LoadConfig
+	filePodTemplate map[string]interface{}
+	// Priority orders candidates by weight of first matching group, lower weight first
+	Priority []PriorityGroup `json:"priority"`
+	// TieBreaker orders candidates of same weight, oldest-first, largest-first or smallest-first
+	TieBreaker string `json:"tieBreaker"`
+	// Profiles override resources, batch, env, image tag and storage class of tasks, first selecting profile wins
+	Profiles []JobProfile `json:"profiles"`
+}
+
+// Result summarizes what a single reconcile pass saw and did
+type Result struct {
+	Candidates  []string `json:"candidates"`
+	OrphanPVCs  []string `json:"orphanPVCs"`
+	DeletedPods []string `json:"deletedPods"`
+	Completed   []string `json:"completed"`
+	Failed      []string `json:"failed"`
+	Ongoing     []string `json:"ongoing"`
+	Slots       int      `json:"slots"`
+	Scheduled   []string `json:"scheduled"`
+	PatchedPVs  []string `json:"patchedPVs"`
+	// NotifyFailures are notifications not delivered after retries
+	NotifyFailures []string `json:"notifyFailures"`
+	DeletedIndices []string `json:"deletedIndices"`
+	ClosedIndices  []string `json:"closedIndices"`
+	Verified       []string `json:"verified"`
+	// Suspicious are archives not matching their index, kept in elasticsearch and not archived again unless forced
+	Suspicious []string `json:"suspicious"`
+	// Quarantined are indices not archived again after too many failed tasks
+	Quarantined []string `json:"quarantined"`
+	// Kept are failed jobs kept for inspection
+	Kept []string `json:"kept"`
+	// RecordFailures are indices whose ledger record failed to write, their tasks are kept for the next pass
+	RecordFailures []string `json:"recordFailures"`
+	// RemoveFailures are archived indices failed to delete or close, retried by later passes
+	RemoveFailures []string `json:"removeFailures"`
+}
+
+// Reconciler cleans up finished esbridge tasks and schedules new ones for candidate indices
+type Reconciler struct {
+	Options Options
+	Kube    kubernetes.Interface
+	Indices IndexStore
+
+	// Now returns current time, replaceable for testing
+	Now func() time.Time
+	// Sleep waits for cluster to settle, replaceable for testing
+	Sleep func(ctx context.Context, d time.Duration) error
+	// Metrics collects pipeline metrics if not nil
+	Metrics *Metrics
+	// StartedAt is when the reconciler was created, forceReindex applies to indices archived before
+	StartedAt time.Time
+}
+
+// NewReconciler creates a Reconciler with real clock
+func NewReconciler(opts Options, kube kubernetes.Interface, indices IndexStore) *Reconciler {
+	return &Reconciler{
+		Options:   opts,
+		Kube:      kube,
+		Indices:   indices,
+		Now:       time.Now,
+		Sleep:     sleepContext,
+		StartedAt: time.Now(),
+	}
+}
+
+// log returns logger with namespace and dry run of reconciler
+func (r *Reconciler) log() *Logger {
+	return logger.With(Fields{"namespace": r.Options.Namespace, "dry_run": r.Options.DryRun})
+}
+
+// Reconcile runs a single pass: cleanup orphans, count jobs and schedule candidates
+func (r *Reconciler) Reconcile(ctx context.Context) (res *Result, err error) {
+	var plan *Plan
+	if plan, err = r.Plan(ctx); err != nil {
+		r.observeReconcile(nil, nil, err)
+		return
+	}
+	res, err = r.Apply(ctx, plan)
+	r.observeReconcile(plan, res, err)
+	return
+}
+
+// observeReconcile records a pass in metrics if enabled
+func (r *Reconciler) observeReconcile(plan *Plan, res *Result, err error) {
+	if r.Metrics != nil {
+		r.Metrics.observeReconcile(plan, res, err, r.Now())
+	}
+}
+
+// Candidate is an index old enough to be archived
+type Candidate struct {
+	Index     string        `json:"index"`
+	Date      time.Time     `json:"date"`
+	Retention RetentionRule `json:"retention"`
+	// AgeSource is the age source the date is taken from
+	AgeSource string `json:"ageSource"`
+	// Size is primary store size of index in bytes
+	Size int64 `json:"size"`
+	// Storage is pvc size in bytes
+	Storage int64 `json:"storage"`
+	// Node the task is pinned to, empty if node budgets are not configured
+	Node string `json:"node,omitempty"`
+	// Profile is name of the job profile selecting the index, empty if none
+	Profile string `json:"profile,omitempty"`
+}
+
+func (r *Reconciler) candidates(ctx context.Context) (candidates []Candidate, err error) {
+	var items []InventoryItem
+	if items, err = r.Inventory(ctx); err != nil {
+		return
+	}
+	return r.candidatesOf(items)
+}
+
+// candidatesOf returns candidates of inventory in scheduling order
+func (r *Reconciler) candidatesOf(items []InventoryItem) (candidates []Candidate, err error) {
+	var priority *priorityPolicy
+	if priority, err = newPriorityPolicy(r.Options.Priority, r.Options.TieBreaker); err != nil {
+		return
+	}
+	var profiles *profilePolicy
+	if profiles, err = newProfilePolicy(r.Options.Profiles); err != nil {
+		return
+	}
+
+	for _, item := range items {
+		if !item.Candidate {
+			continue
+		}
+		candidates = append(candidates, Candidate{
+			Index:     item.Name,
+			Date:      item.Date,
+			Retention: item.Retention,
+			AgeSource: item.AgeSource,
+			Size:      item.PriStoreSize,
+			Storage:   r.storageFor(item.PriStoreSize),
+			Profile:   profiles.profileOf(item.Name, item.PriStoreSize),
+		})
+	}
+
+	priority.sort(candidates)
+
+	for _, c := range candidates {
+		fields := Fields{
+			"index":      c.Index,
+			"retention":  c.Retention.String(),
+			"age_source": c.AgeSource,
+			"size":       formatBytes(c.Size),
+			"storage":    formatBytes(c.Storage),
+		}
+		if c.Profile != "" {
+			fields["profile"] = c.Profile
+		}
+		r.log().With(fields).Info("Candidate")
+	}
+	return
+}
+
+// storageFor returns pvc size in bytes for an index of size bytes, rounded up to Mi
+func (r *Reconciler) storageFor(size int64) int64 {
+	opts := r.Options
+	if opts.StorageFactor <= 0 {
+		fixed := resource.MustParse(opts.StorageRequest)
+		return fixed.Value()
+	}
+	const mi = 1024 * 1024
+	storage := int64(math.Ceil(float64(size)*opts.StorageFactor/mi)) * mi
+	if min := resource.MustParse(opts.StorageMin); storage < min.Value() {
+		storage = min.Value()
+	}
+	if max := resource.MustParse(opts.StorageMax); storage > max.Value() {
+		storage = max.Value()
+	}
+	return storage
+}
+
+func (r *Reconciler) buildPVC(c Candidate) *corev1.PersistentVolumeClaim {
+	opts := r.Options
+	index := c.Index
+	taskName := taskNameFromIndex(index)
+
+	pvc := &corev1.PersistentVolumeClaim{}
+	pvc.Namespace = opts.Namespace
+	pvc.Name = taskName
+	pvc.Labels = map[string]string{
+		taskLabelKey: taskLabelValue,
+	}
+	storage := resource.NewQuantity(c.Storage, resource.BinarySI)
+	pvc.Annotations = map[string]string{
+		indexAnnotationKey:   index,
+		storageAnnotationKey: storage.String(),
+	}
+	pvc.Spec.AccessModes = append(pvc.Spec.AccessModes, corev1.ReadWriteOnce)
+	storageClass := opts.StorageClass
+	if profile := findProfile(opts.Profiles, c.Profile); profile != nil && profile.StorageClass != "" {
+		storageClass = profile.StorageClass
+	}
+	pvc.Spec.StorageClassName = &storageClass
+	pvc.Spec.Resources.Requests = corev1.ResourceList{
+		corev1.ResourceStorage: *storage,
+	}
+	return pvc
+}
+
+func (r *Reconciler) buildJob(c Candidate) (job *batchv1.Job, err error) {
+	opts := r.Options
+	index := c.Index
+	taskName := taskNameFromIndex(index)
+
+	job = &batchv1.Job{}
+	job.Namespace = opts.Namespace
+	job.Name = taskName
+	job.Labels = map[string]string{
+		taskLabelKey: taskLabelValue,
+	}
+	job.Annotations = map[string]string{
+		indexAnnotationKey:     index,
+		retentionAnnotationKey: c.Retention.String(),
+		storageAnnotationKey:   resource.NewQuantity(c.Storage, resource.BinarySI).String(),
+		sizeAnnotationKey:      strconv.FormatInt(c.Size, 10),
+	}
+	profile := findProfile(opts.Profiles, c.Profile)
+	if profile != nil {
+		job.Annotations[profileAnnotationKey] = profile.Name
+	}
+	job.Spec.Template.Labels = map[string]string{
+		"k8s-app":    taskName,
+		taskLabelKey: taskLabelValue,
+	}
+	job.Spec.Template.Annotations = map[string]string{
+		indexAnnotationKey: index,
+	}
+	for key, val := range opts.PodAnnotations {
+		if val != "" {
+			job.Spec.Template.Annotations[key] = val
+		}
+	}
+	spec := corev1.PodSpec{}
+
+	container := corev1.Container{}
+
+	container.Name = taskName
+	container.Image = opts.Image
+	container.ImagePullPolicy = opts.ImagePullPolicy
+	container.Env = append(container.Env, corev1.EnvVar{
+		Name:  "ESBRIDGE_INDEX",
+		Value: index,
+	})
+	container.Env = append(container.Env, corev1.EnvVar{
+		Name:  "ESBRIDGE_BATCH_SIZE",
+		Value: opts.Batch,
+	})
+	container.Env = append(container.Env, corev1.EnvVar{
+		Name:  "ESBRIDGE_RESULT_CONFIGMAP",
+		Value: resultConfigMapName(taskName),
+	})
+	container.Resources = *opts.Resources.DeepCopy()
+	container.VolumeMounts = []corev1.VolumeMount{
+		{
+			MountPath: opts.DataMount,
+			Name:      "vol-data",
+		},
+		{
+			MountPath: "/etc/esbridge.yml",
+			Name:      "vol-cfg",
+			SubPath:   opts.ConfigMapKey,
+		},
+	}
+	if profile != nil {
+		profile.apply(&container)
+	}
+
+	env := opts.Env
+	if profile != nil {
+		env = append(append([]corev1.EnvVar{}, opts.Env...), profile.Env...)
+	}
+	if env, err = renderEnv(env, EnvData{Index: index, Date: c.Date, Task: taskName}); err != nil {
+		return
+	}
+	for _, e := range env {
+		setEnv(&container, e)
+	}
+	for _, name := range opts.EnvFromSecrets {
+		container.EnvFrom = append(container.EnvFrom, corev1.EnvFromSource{
+			SecretRef: &corev1.SecretEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: name}},
+		})
+	}
+	for _, name := range opts.EnvFromConfigMaps {
+		container.EnvFrom = append(container.EnvFrom, corev1.EnvFromSource{
+			ConfigMapRef: &corev1.ConfigMapEnvSource{LocalObjectReference: corev1.LocalObjectReference{Name: name}},
+		})
+	}
+
+	spec.Containers = []corev1.Container{container}
+	spec.RestartPolicy = corev1.RestartPolicyOnFailure
+	if c.Node != "" {
+		spec.NodeSelector = map[string]string{hostnameLabelKey: c.Node}
+	}
+
+	volCfg := corev1.Volume{}
+	volCfg.Name = "vol-cfg"
+	volCfg.ConfigMap = &corev1.ConfigMapVolumeSource{}
+	volCfg.ConfigMap.Name = opts.ConfigMap
+	volCfg.ConfigMap.DefaultMode = &accessMode
+
+	volData := corev1.Volume{}
+	volData.Name = "vol-data"
+	volData.PersistentVolumeClaim = &corev1.PersistentVolumeClaimVolumeSource{}
+	volData.PersistentVolumeClaim.ClaimName = taskName
+
+	spec.Volumes = []corev1.Volume{volCfg, volData}
+
+	job.Spec.Template.Spec = spec
+
+	if err = mergePodTemplate(&job.Spec.Template, opts.filePodTemplate, opts.PodTemplate); err != nil {
+		err = fmt.Errorf("failed to merge pod template: %s", err.Error())
+	}
+	return
+}
+
+// pvcSummary returns log fields of a pvc to create
+func pvcSummary(pvc *corev1.PersistentVolumeClaim) Fields {
+	f := Fields{"pvc": pvc.Name, "index": pvc.Annotations[indexAnnotationKey], "storage": pvc.Annotations[storageAnnotationKey]}
+	if pvc.Spec.StorageClassName != nil {
+		f["storage_class"] = *pvc.Spec.StorageClassName
+	}
+	return f
+}
+
+// jobSummary returns log fields of a job to create
+func jobSummary(job *batchv1.Job) Fields {
+	f := Fields{"job": job.Name, "index": job.Annotations[indexAnnotationKey], "storage": job.Annotations[storageAnnotationKey]}
+	if profile := job.Annotations[profileAnnotationKey]; profile != "" {
+		f["profile"] = profile
+	}
+	if containers := job.Spec.Template.Spec.Containers; len(containers) > 0 {
+		f["image"] = containers[0].Image
+	}
+	if node := job.Spec.Template.Spec.NodeSelector[hostnameLabelKey]; node != "" {
+		f["node"] = node
+	}
+	return f
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/olivere/elastic/v7"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testNamespace = "esmaint"
+
+// newFakeES serves rows as cat indices, the "newest" key of a row is served as max aggregation of its index,
+// deleting an index removes its row, closing sets its status
+func newFakeES(t *testing.T, rows []map[string]string) *elastic.Client {
+	var mu sync.Mutex
+	s := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		rw.Header().Set("Content-Type", "application/json")
+		index := strings.Split(strings.TrimPrefix(req.URL.Path, "/"), "/")[0]
+		if req.Method == http.MethodDelete || strings.HasSuffix(req.URL.Path, "/_close") {
+			for i, row := range rows {
+				if row["index"] != index {
+					continue
+				}
+				if req.Method == http.MethodDelete {
+					rows = append(rows[:i:i], rows[i+1:]...)
+				} else {
+					row["status"] = IndexStatusClosed
+				}
+				_, _ = rw.Write([]byte(`{"acknowledged": true}`))
+				return
+			}
+			http.NotFound(rw, req)
+			return
+		}
+		if req.URL.Path == "/_cat/indices" {
+			_ = json.NewEncoder(rw).Encode(rows)
+			return
+		}
+		if strings.HasSuffix(req.URL.Path, "/_search") {
+			for _, row := range rows {
+				if row["index"] != index {
+					continue
+				}
+				var value interface{}
+				if row["newest"] != "" {
+					value = json.Number(row["newest"])
+				}
+				_ = json.NewEncoder(rw).Encode(map[string]interface{}{
+					"hits":         map[string]interface{}{"total": map[string]interface{}{"value": 0}},
+					"aggregations": map[string]interface{}{"newest": map[string]interface{}{"value": value}},
+				})
+				return
+			}
+		}
+		http.NotFound(rw, req)
+	}))
+	t.Cleanup(s.Close)
+	client, err := elastic.NewClient(elastic.SetURL(s.URL), elastic.SetSniff(false), elastic.SetHealthcheck(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+func testOptions() Options {
+	opts := DefaultConfig().Options
+	opts.Tasks = 2
+	opts.Days = 30
+	opts.Ignores = []string{"ignored-2021-01-01"}
+	return opts
+}
+
+// newTestReconciler wires a Reconciler to fake kubernetes and elasticsearch, with PVCs bound on creation
+func newTestReconciler(t *testing.T, opts Options, rows []map[string]string) (*Reconciler, *fakeKube) {
+	kube := newFakeKube(t)
+	kube.OnCreate = func(resource string, obj map[string]interface{}) {
+		if resource != "persistentvolumeclaims" {
+			return
+		}
+		meta := obj["metadata"].(map[string]interface{})
+		pvName := "pv-" + meta["name"].(string)
+		obj["spec"].(map[string]interface{})["volumeName"] = pvName
+		kube.store("persistentvolumes", map[string]interface{}{
+			"metadata": map[string]interface{}{"name": pvName},
+			"spec":     map[string]interface{}{"persistentVolumeReclaimPolicy": "Delete"},
+		})
+	}
+	r := NewReconciler(opts, kube.Client, NewElasticIndexStore(newFakeES(t, rows)))
+	r.Now = func() time.Time {
+		return time.Date(2021, 3, 10, 8, 0, 0, 0, time.Local)
+	}
+	r.Sleep = func(ctx context.Context, d time.Duration) error {
+		return nil
+	}
+	return r, kube
+}
+
+func taskObjectMeta(name, index string) metav1.ObjectMeta {
+	return metav1.ObjectMeta{
+		Name:        name,
+		Namespace:   testNamespace,
+		Labels:      map[string]string{taskLabelKey: taskLabelValue},
+		Annotations: map[string]string{indexAnnotationKey: index},
+	}
+}
+
+func finishedJob(index string, condType batchv1.JobConditionType) *batchv1.Job {
+	job := &batchv1.Job{ObjectMeta: taskObjectMeta(taskNameFromIndex(index), index)}
+	job.Status.Conditions = []batchv1.JobCondition{
+		{Type: condType, Status: corev1.ConditionTrue},
+	}
+	return job
+}
+
+func TestReconcilerSchedulesCandidates(t *testing.T) {
+	r, kube := newTestReconciler(t, testOptions(), []map[string]string{
+		{"index": ".kibana"},
+		{"index": "ignored-2021-01-01"},
+		{"index": "no-date"},
+		{"index": "info-prod-2021-01-02"},
+		{"index": "debug-test-2021-01-03"},
+		{"index": "debug-test-2021-01-01"},
+		{"index": "debug-test-2021-03-09"},
+	})
+
+	res, err := r.Reconcile(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"debug-test-2021-01-01", "debug-test-2021-01-03", "info-prod-2021-01-02"}; !reflect.DeepEqual(res.Candidates, want) {
+		t.Fatalf("candidates = %v, want %v", res.Candidates, want)
+	}
+	if res.Slots != 2 {
+		t.Fatalf("slots = %d, want 2", res.Slots)
+	}
+	if want := []string{"debug-test-2021-01-01", "debug-test-2021-01-03"}; !reflect.DeepEqual(res.Scheduled, want) {
+		t.Fatalf("scheduled = %v, want %v", res.Scheduled, want)
+	}
+
+	job := &batchv1.Job{}
+	if !kube.Get(job, testNamespace, "task-debug-test-2021-01-01") {
+		t.Fatal("job not created")
+	}
+	if job.Annotations[indexAnnotationKey] != "debug-test-2021-01-01" {
+		t.Fatalf("job annotations = %v", job.Annotations)
+	}
+	if env := job.Spec.Template.Spec.Containers[0].Env; env[0].Value != "debug-test-2021-01-01" || env[1].Value != "2000" {
+		t.Fatalf("job env = %v", env)
+	}
+
+	pv := &corev1.PersistentVolume{}
+	kube.Get(pv, "", "pv-task-debug-test-2021-01-03")
+	if pv.Spec.PersistentVolumeReclaimPolicy != corev1.PersistentVolumeReclaimRetain {
+		t.Fatalf("pv reclaim policy = %s", pv.Spec.PersistentVolumeReclaimPolicy)
+	}
+}
+
+func TestReconcilerCleansUpFinishedTasks(t *testing.T) {
+	r, kube := newTestReconciler(t, testOptions(), []map[string]string{
+		{"index": "a-2021-01-01"},
+		{"index": "b-2021-01-01"},
+		{"index": "c-2021-01-01"},
+	})
+
+	kube.Add(&corev1.PersistentVolumeClaim{ObjectMeta: taskObjectMeta("task-orphan-2021-01-01", "orphan-2021-01-01")})
+	kube.Add(&corev1.Pod{ObjectMeta: taskObjectMeta("task-a-2021-01-01-xxxxx", "a-2021-01-01"), Status: corev1.PodStatus{Phase: corev1.PodSucceeded}})
+	kube.Add(finishedJob("a-2021-01-01", batchv1.JobComplete))
+	kube.Add(&corev1.PersistentVolumeClaim{ObjectMeta: taskObjectMeta("task-a-2021-01-01", "a-2021-01-01")})
+	kube.Add(finishedJob("b-2021-01-01", batchv1.JobFailed))
+	kube.Add(&batchv1.Job{ObjectMeta: taskObjectMeta("task-c-2021-01-01", "c-2021-01-01")})
+	// the job controller has not counted this pod yet
+	pod := &corev1.Pod{ObjectMeta: taskObjectMeta("task-c-2021-01-01-xxxxx", "c-2021-01-01"), Status: corev1.PodStatus{Phase: corev1.PodSucceeded}}
+	pod.Labels["job-name"] = "task-c-2021-01-01"
+	kube.Add(pod)
+
+	res, err := r.Reconcile(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if want := []string{"task-orphan-2021-01-01"}; !reflect.DeepEqual(res.OrphanPVCs, want) {
+		t.Fatalf("orphan pvcs = %v, want %v", res.OrphanPVCs, want)
+	}
+	if want := []string{"task-a-2021-01-01-xxxxx"}; !reflect.DeepEqual(res.DeletedPods, want) {
+		t.Fatalf("deleted pods = %v, want %v", res.DeletedPods, want)
+	}
+	if want := []string{"task-a-2021-01-01"}; !reflect.DeepEqual(res.Completed, want) {
+		t.Fatalf("completed = %v, want %v", res.Completed, want)
+	}
+	if want := []string{"task-b-2021-01-01"}; !reflect.DeepEqual(res.Failed, want) {
+		t.Fatalf("failed = %v, want %v", res.Failed, want)
+	}
+	if want := []string{"task-c-2021-01-01"}; !reflect.DeepEqual(res.Ongoing, want) {
+		t.Fatalf("ongoing = %v, want %v", res.Ongoing, want)
+	}
+	// c is ongoing, a and b are finished and free their slots
+	if res.Slots != 1 {
+		t.Fatalf("slots = %d, want 1", res.Slots)
+	}
+	// a completed without a manifest, it's suspicious and not archived again, b is backing off
+	if len(res.Scheduled) != 0 || len(res.Suspicious) != 1 || !strings.HasPrefix(res.Suspicious[0], "a-2021-01-01: ") {
+		t.Fatalf("scheduled = %v, suspicious = %v", res.Scheduled, res.Suspicious)
+	}
+	if want := []string{"task-c-2021-01-01"}; !reflect.DeepEqual(kube.Names("jobs"), want) {
+		t.Fatalf("jobs = %v, want %v", kube.Names("jobs"), want)
+	}
+	if want := []string{"task-c-2021-01-01-xxxxx"}; !reflect.DeepEqual(kube.Names("pods"), want) {
+		t.Fatalf("pods = %v, want %v", kube.Names("pods"), want)
+	}
+}
+
+func TestReconcilerDryRun(t *testing.T) {
+	opts := testOptions()
+	opts.DryRun = true
+	r, kube := newTestReconciler(t, opts, []map[string]string{
+		{"index": "a-2021-01-01"},
+	})
+	kube.Add(finishedJob("b-2021-01-01", batchv1.JobComplete))
+
+	res, err := r.Reconcile(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a-2021-01-01"}; !reflect.DeepEqual(res.Scheduled, want) {
+		t.Fatalf("scheduled = %v, want %v", res.Scheduled, want)
+	}
+	if want := []string{"task-b-2021-01-01"}; !reflect.DeepEqual(kube.Names("jobs"), want) {
+		t.Fatalf("jobs = %v, want %v", kube.Names("jobs"), want)
+	}
+	if names := kube.Names("persistentvolumeclaims"); len(names) != 0 {
+		t.Fatalf("pvcs = %v, want none", names)
+	}
+}
+
+func TestReconcilerAgeSources(t *testing.T) {
+	millis := func(year int, month time.Month, day int) string {
+		return strconv.FormatInt(time.Date(year, month, day, 12, 0, 0, 0, time.Local).UnixNano()/int64(time.Millisecond), 10)
+	}
+	opts := testOptions()
+	opts.Tasks = 0
+	opts.AgeSources = []string{AgeSourceName, AgeSourceCreation, AgeSourceTimestamp}
+	r, _ := newTestReconciler(t, opts, []map[string]string{
+		{"index": "a-2021-01-01", "creation.date": millis(2021, 3, 9)},
+		{"index": "logs-000001", "creation.date": millis(2021, 1, 5)},
+		{"index": "logs-000002", "creation.date": millis(2021, 3, 1), "newest": millis(2021, 1, 1)},
+		{"index": "rollup-000001", "newest": millis(2021, 2, 7)},
+		{"index": "rollup-000002", "newest": millis(2021, 2, 9)},
+		{"index": "empty-000001"},
+	})
+
+	candidates, err := r.candidates(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]string{}
+	for _, c := range candidates {
+		got[c.Index] = c.AgeSource
+	}
+	want := map[string]string{
+		"a-2021-01-01":  AgeSourceName,
+		"logs-000001":   AgeSourceCreation,
+		"rollup-000001": AgeSourceTimestamp,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("candidates = %v, want %v", got, want)
+	}
+}
+
+func TestReconcilerSizesPVC(t *testing.T) {
+	const gi = 1024 * 1024 * 1024
+	opts := testOptions()
+	opts.Tasks = 3
+	opts.StorageFactor = 2
+	opts.StorageMin = "5Gi"
+	opts.StorageMax = "100Gi"
+	r, kube := newTestReconciler(t, opts, []map[string]string{
+		{"index": "small-2021-01-01", "pri.store.size": strconv.Itoa(gi / 2)},
+		{"index": "medium-2021-01-01", "pri.store.size": strconv.Itoa(gi*10 + 1)},
+		{"index": "huge-2021-01-01", "pri.store.size": strconv.Itoa(gi * 1000)},
+	})
+
+	if _, err := r.Reconcile(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	for index, want := range map[string]string{
+		"small-2021-01-01":  "5Gi",
+		"medium-2021-01-01": "20481Mi",
+		"huge-2021-01-01":   "100Gi",
+	} {
+		pvc := &corev1.PersistentVolumeClaim{}
+		if !kube.Get(pvc, testNamespace, taskNameFromIndex(index)) {
+			t.Fatalf("pvc of %s not created", index)
+		}
+		if got := pvc.Spec.Resources.Requests.Storage().String(); got != want {
+			t.Errorf("pvc of %s = %s, want %s", index, got, want)
+		}
+		if got := pvc.Annotations[storageAnnotationKey]; got != want {
+			t.Errorf("pvc annotation of %s = %s, want %s", index, got, want)
+		}
+		job := &batchv1.Job{}
+		kube.Get(job, testNamespace, taskNameFromIndex(index))
+		if got := job.Annotations[storageAnnotationKey]; got != want {
+			t.Errorf("job annotation of %s = %s, want %s", index, got, want)
+		}
+	}
+}
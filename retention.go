@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	retentionDefault = "default"
+)
+
+// RetentionRule keeps indices matching Pattern for Days, see compileIndexPattern for pattern syntax
+type RetentionRule struct {
+	Pattern string `json:"pattern"`
+	Days    int    `json:"days"`
+}
+
+func (r RetentionRule) String() string {
+	return fmt.Sprintf("%s=%dd", r.Pattern, r.Days)
+}
+
+// retentionPolicy resolves retention rule of an index, first matching rule wins
+type retentionPolicy struct {
+	rules    []RetentionRule
+	matchers []indexMatcher
+	fallback RetentionRule
+}
+
+func newRetentionPolicy(rules []RetentionRule, days int) (p *retentionPolicy, err error) {
+	p = &retentionPolicy{
+		rules:    rules,
+		fallback: RetentionRule{Pattern: retentionDefault, Days: days},
+	}
+	for _, rule := range rules {
+		if rule.Days < 0 {
+			err = fmt.Errorf("invalid retention rule %s: days must not be negative", rule.String())
+			return
+		}
+		var m indexMatcher
+		if m, err = compileIndexPattern(rule.Pattern); err != nil {
+			return
+		}
+		p.matchers = append(p.matchers, m)
+	}
+	return
+}
+
+func (p *retentionPolicy) ruleFor(index string) RetentionRule {
+	for i, m := range p.matchers {
+		if m(index) {
+			return p.rules[i]
+		}
+	}
+	return p.fallback
+}
+
+// retentionRules is a flag.Value for comma separated rules like "access-prod-*=180d,debug-*=14d"
+type retentionRules []RetentionRule
+
+func (l *retentionRules) String() string {
+	var items []string
+	for _, rule := range *l {
+		items = append(items, rule.String())
+	}
+	return strings.Join(items, ",")
+}
+
+func (l *retentionRules) Set(s string) (err error) {
+	*l = nil
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		i := strings.LastIndex(item, "=")
+		if i < 0 {
+			return fmt.Errorf("invalid retention rule %s, should be PATTERN=DAYS", item)
+		}
+		var days int
+		if days, err = strconv.Atoi(strings.TrimSuffix(item[i+1:], "d")); err != nil {
+			return fmt.Errorf("invalid retention rule %s, should be PATTERN=DAYS", item)
+		}
+		*l = append(*l, RetentionRule{Pattern: item[:i], Days: days})
+	}
+	return
+}
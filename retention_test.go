@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	batchv1 "k8s.io/api/batch/v1"
+	"reflect"
+	"testing"
+)
+
+func TestRetentionRulesFlag(t *testing.T) {
+	var rules retentionRules
+	if err := rules.Set("access-prod-*=180d, /^debug-/=14"); err != nil {
+		t.Fatal(err)
+	}
+	want := retentionRules{{Pattern: "access-prod-*", Days: 180}, {Pattern: "/^debug-/", Days: 14}}
+	if !reflect.DeepEqual(rules, want) {
+		t.Fatalf("rules = %v, want %v", rules, want)
+	}
+	if err := rules.Set("access-prod-*"); err == nil {
+		t.Fatal("expected error for rule without days")
+	}
+}
+
+func TestRetentionPolicy(t *testing.T) {
+	p, err := newRetentionPolicy([]RetentionRule{
+		{Pattern: "access-prod-*", Days: 180},
+		{Pattern: "/^debug-/", Days: 14},
+		{Pattern: "access-*", Days: 60},
+	}, 95)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for index, want := range map[string]string{
+		"access-prod-2021-01-01": "access-prod-*=180d",
+		"access-test-2021-01-01": "access-*=60d",
+		"debug-prod-2021-01-01":  "/^debug-/=14d",
+		"info-prod-2021-01-01":   "default=95d",
+	} {
+		if got := p.ruleFor(index).String(); got != want {
+			t.Errorf("rule for %s = %s, want %s", index, got, want)
+		}
+	}
+
+	if _, err = newRetentionPolicy([]RetentionRule{{Pattern: "/(/", Days: 1}}, 95); err == nil {
+		t.Error("expected error for invalid regexp")
+	}
+}
+
+func TestReconcilerRetention(t *testing.T) {
+	opts := testOptions()
+	opts.Retention = []RetentionRule{
+		{Pattern: "access-*", Days: 180},
+		{Pattern: "debug-*", Days: 3},
+	}
+	r, kube := newTestReconciler(t, opts, []map[string]string{
+		{"index": "access-2021-01-01"},
+		{"index": "debug-2021-03-05"},
+		{"index": "info-2021-03-05"},
+	})
+
+	res, err := r.Reconcile(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"debug-2021-03-05"}; !reflect.DeepEqual(res.Candidates, want) {
+		t.Fatalf("candidates = %v, want %v", res.Candidates, want)
+	}
+	job := &batchv1.Job{}
+	kube.Get(job, testNamespace, "task-debug-2021-03-05")
+	if got := job.Annotations[retentionAnnotationKey]; got != "debug-*=3d" {
+		t.Fatalf("retention annotation = %s", got)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"time"
+)
+
+// retryPolicy backs off an index exponentially after each failed task, and quarantines it after max attempts
+type retryPolicy struct {
+	backoff     time.Duration
+	maxBackoff  time.Duration
+	maxAttempts int
+}
+
+func newRetryPolicy(opts Options) retryPolicy {
+	return retryPolicy{
+		backoff:     opts.RetryBackoff.Duration,
+		maxBackoff:  opts.RetryBackoffMax.Duration,
+		maxAttempts: opts.MaxAttempts,
+	}
+}
+
+// delay returns the backoff after failures consecutive failed tasks
+func (p retryPolicy) delay(failures int) time.Duration {
+	if p.backoff <= 0 || failures <= 0 {
+		return 0
+	}
+	d := p.backoff
+	for i := 1; i < failures; i++ {
+		if d *= 2; p.maxBackoff > 0 && d >= p.maxBackoff {
+			return p.maxBackoff
+		}
+	}
+	if p.maxBackoff > 0 && d > p.maxBackoff {
+		return p.maxBackoff
+	}
+	return d
+}
+
+// apply updates retry state of a record just updated by a finished task, a task finished at unknown time counts as now
+func (p retryPolicy) apply(rec *LedgerRecord, now time.Time) {
+	rec.NextRetryAt = time.Time{}
+	if rec.Outcome != OutcomeFailed {
+		rec.Failures = 0
+		rec.Quarantined = false
+		return
+	}
+	rec.Failures++
+	if p.maxAttempts > 0 && rec.Failures >= p.maxAttempts {
+		rec.Quarantined = true
+		logger.With(Fields{"index": rec.Index, "job": rec.Job, "failures": rec.Failures}).Warn("Quarantined")
+		return
+	}
+	if d := p.delay(rec.Failures); d > 0 {
+		finishedAt := rec.FinishedAt
+		if finishedAt.IsZero() {
+			finishedAt = now
+		}
+		rec.NextRetryAt = finishedAt.Add(d)
+		logger.With(Fields{"index": rec.Index, "job": rec.Job, "failures": rec.Failures, "retry_at": rec.NextRetryAt}).Info("Backoff")
+	}
+}
+
+// waiting returns the skip reason if the index of record is quarantined or in backoff
+func (rec LedgerRecord) waiting(now time.Time) string {
+	if rec.Quarantined {
+		return SkipQuarantined
+	}
+	if rec.NextRetryAt.After(now) {
+		return SkipBackoff
+	}
+	return ""
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	batchv1 "k8s.io/api/batch/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicyDelay(t *testing.T) {
+	p := retryPolicy{backoff: time.Minute, maxBackoff: 10 * time.Minute}
+	for failures, want := range map[int]time.Duration{
+		0:  0,
+		1:  time.Minute,
+		2:  2 * time.Minute,
+		4:  8 * time.Minute,
+		5:  10 * time.Minute,
+		80: 10 * time.Minute,
+	} {
+		if d := p.delay(failures); d != want {
+			t.Errorf("delay(%d) = %s, want %s", failures, d, want)
+		}
+	}
+}
+
+func TestReconcilerBacksOffAndQuarantines(t *testing.T) {
+	opts := testOptions()
+	opts.RetryBackoff = metav1.Duration{Duration: time.Hour}
+	opts.MaxAttempts = 3
+	r, kube := newTestReconciler(t, opts, []map[string]string{
+		{"index": "a-2021-01-01"},
+	})
+	now := r.Now()
+	r.Now = func() time.Time { return now }
+
+	fail := func() *Result {
+		kube.Add(finishedJob("a-2021-01-01", batchv1.JobFailed))
+		res, err := r.Reconcile(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	// first failure backs off an hour
+	if res := fail(); len(res.Scheduled) != 0 {
+		t.Fatalf("scheduled = %v, want backoff", res.Scheduled)
+	}
+	now = now.Add(59 * time.Minute)
+	if res, _ := r.Reconcile(context.Background()); len(res.Scheduled) != 0 {
+		t.Fatalf("scheduled = %v, want backoff", res.Scheduled)
+	}
+	now = now.Add(time.Minute)
+	if res, _ := r.Reconcile(context.Background()); len(res.Scheduled) != 1 {
+		t.Fatalf("scheduled = %v, want retry", res.Scheduled)
+	}
+
+	// second failure backs off two hours, third quarantines
+	fail()
+	records, _ := r.ledger().Load(context.Background())
+	if rec := records["a-2021-01-01"]; rec.Failures != 2 || !rec.NextRetryAt.Equal(now.Add(2*time.Hour)) {
+		t.Fatalf("record = %+v", rec)
+	}
+	now = now.Add(2 * time.Hour)
+	res := fail()
+	if want := []string{"a-2021-01-01"}; !reflect.DeepEqual(res.Quarantined, want) || len(res.Scheduled) != 0 {
+		t.Fatalf("quarantined = %v, scheduled = %v", res.Quarantined, res.Scheduled)
+	}
+	now = now.Add(24 * time.Hour)
+	if res, _ = r.Reconcile(context.Background()); len(res.Scheduled) != 0 || len(res.Quarantined) != 1 {
+		t.Fatalf("quarantined = %v, scheduled = %v", res.Quarantined, res.Scheduled)
+	}
+
+	// a completed task resets failures
+	records, _ = r.ledger().Load(context.Background())
+	rec := records["a-2021-01-01"]
+	rec.Quarantined = false
+	if err := r.ledger().Put(context.Background(), rec); err != nil {
+		t.Fatal(err)
+	}
+	if res, _ = r.Reconcile(context.Background()); len(res.Scheduled) != 1 {
+		t.Fatalf("scheduled = %v, want retry", res.Scheduled)
+	}
+	kube.Add(finishedJob("a-2021-01-01", batchv1.JobComplete))
+	if _, err := r.Reconcile(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	records, _ = r.ledger().Load(context.Background())
+	if rec = records["a-2021-01-01"]; rec.Failures != 0 || rec.Quarantined || !rec.NextRetryAt.IsZero() || rec.Attempts != 4 {
+		t.Fatalf("record = %+v", rec)
+	}
+}
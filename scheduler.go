@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	batchv1 "k8s.io/api/batch/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"sort"
+	"strings"
+)
+
+const (
+	hostnameLabelKey = "kubernetes.io/hostname"
+)
+
+// scheduler packs candidates under task slots, total storage budget and per node storage budgets
+type scheduler struct {
+	slots int
+	// budget is remaining bytes in flight if limited, negative when over budget
+	limited bool
+	budget  int64
+	// nodes is remaining bytes of each node, empty if node budgets are not configured
+	nodes     map[string]int64
+	nodeNames []string
+}
+
+// newScheduler creates a scheduler with storage of ongoing tasks already taken, node of a task may be unknown
+func newScheduler(opts Options, slots int, inFlight int64, inFlightByNode map[string]int64) *scheduler {
+	s := &scheduler{slots: slots, nodes: map[string]int64{}}
+	if opts.StorageBudget != "" {
+		budget := resource.MustParse(opts.StorageBudget)
+		s.limited, s.budget = true, budget.Value()-inFlight
+	}
+	for node, quantity := range opts.NodeBudgets {
+		budget := resource.MustParse(quantity)
+		s.nodes[node] = budget.Value() - inFlightByNode[node]
+		s.nodeNames = append(s.nodeNames, node)
+	}
+	sort.Strings(s.nodeNames)
+	return s
+}
+
+// full returns true if no more task can be scheduled
+func (s *scheduler) full() bool {
+	return s.slots <= 0
+}
+
+// fit takes a slot and storage for candidate, and pins it to the node with most free storage,
+// returns false if the candidate does not fit
+func (s *scheduler) fit(c *Candidate) bool {
+	if s.slots <= 0 {
+		return false
+	}
+	if s.limited && c.Storage > s.budget {
+		return false
+	}
+	var node string
+	if len(s.nodeNames) > 0 {
+		for _, name := range s.nodeNames {
+			if s.nodes[name] >= c.Storage && (node == "" || s.nodes[name] > s.nodes[node]) {
+				node = name
+			}
+		}
+		if node == "" {
+			return false
+		}
+		s.nodes[node] -= c.Storage
+	}
+	if s.limited {
+		s.budget -= c.Storage
+	}
+	s.slots--
+	c.Node = node
+	return true
+}
+
+// taskStorage returns storage in bytes of a task from job annotation, or from its pvc for jobs created before sizing
+func taskStorage(job batchv1.Job, pvcStorage map[string]int64) int64 {
+	if q, err := resource.ParseQuantity(job.Annotations[storageAnnotationKey]); err == nil {
+		return q.Value()
+	}
+	return pvcStorage[job.Name]
+}
+
+// taskNode returns the node a task is pinned to or running on, empty if unknown
+func taskNode(job batchv1.Job, podNodes map[string]string) string {
+	if node := job.Spec.Template.Spec.NodeSelector[hostnameLabelKey]; node != "" {
+		return node
+	}
+	return podNodes[job.Name]
+}
+
+// nodeBudgets is a flag.Value for comma separated node budgets like "node-1=2Ti,node-2=1Ti"
+type nodeBudgets map[string]string
+
+func (m *nodeBudgets) String() string {
+	var items []string
+	for node, quantity := range *m {
+		items = append(items, node+"="+quantity)
+	}
+	sort.Strings(items)
+	return strings.Join(items, ",")
+}
+
+func (m *nodeBudgets) Set(s string) error {
+	*m = map[string]string{}
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item == "" {
+			continue
+		}
+		i := strings.Index(item, "=")
+		if i < 0 {
+			return fmt.Errorf("invalid node budget %s, should be NODE=QUANTITY", item)
+		}
+		(*m)[item[:i]] = item[i+1:]
+	}
+	return nil
+}
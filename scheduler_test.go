@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	batchv1 "k8s.io/api/batch/v1"
+	"reflect"
+	"strconv"
+	"testing"
+)
+
+const testGi = 1024 * 1024 * 1024
+
+func ongoingJob(index string, storage string, node string) *batchv1.Job {
+	job := &batchv1.Job{ObjectMeta: taskObjectMeta(taskNameFromIndex(index), index)}
+	job.Annotations[storageAnnotationKey] = storage
+	if node != "" {
+		job.Spec.Template.Spec.NodeSelector = map[string]string{hostnameLabelKey: node}
+	}
+	return job
+}
+
+func TestPlanStorageBudget(t *testing.T) {
+	opts := testOptions()
+	opts.Tasks = 4
+	opts.StorageFactor = 1
+	opts.StorageBudget = "30Gi"
+	r, kube := newTestReconciler(t, opts, []map[string]string{
+		{"index": "a-2021-01-01", "pri.store.size": strconv.Itoa(testGi * 15)},
+		{"index": "b-2021-01-02", "pri.store.size": strconv.Itoa(testGi * 10)},
+		{"index": "c-2021-01-03", "pri.store.size": strconv.Itoa(testGi * 3)},
+		{"index": "d-2021-01-04", "pri.store.size": strconv.Itoa(testGi * 1)},
+		{"index": "e-2021-01-05", "pri.store.size": strconv.Itoa(testGi * 1)},
+	})
+	kube.Add(ongoingJob("x-2021-01-01", "10Gi", ""))
+
+	plan, err := r.Plan(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"b-2021-01-02"}; !reflect.DeepEqual(plan.Deferred, want) {
+		t.Fatalf("deferred = %v, want %v", plan.Deferred, want)
+	}
+	var created []string
+	for _, action := range plan.Actions {
+		if action.Kind == ActionCreateJob {
+			created = append(created, action.Index)
+		}
+	}
+	// 3 slots left, b is skipped for budget, e for slots
+	if want := []string{"a-2021-01-01", "c-2021-01-03", "d-2021-01-04"}; !reflect.DeepEqual(created, want) {
+		t.Fatalf("created = %v, want %v", created, want)
+	}
+}
+
+func TestSchedulerOverBudget(t *testing.T) {
+	opts := testOptions()
+	opts.StorageBudget = "100Gi"
+	s := newScheduler(opts, 2, 150*testGi, nil)
+	if c := (Candidate{Index: "a-2021-01-01", Storage: 50 * testGi}); s.fit(&c) {
+		t.Fatalf("fit over budget, budget = %d", s.budget)
+	}
+
+	// no budget is unlimited
+	opts.StorageBudget = ""
+	s = newScheduler(opts, 2, 150*testGi, nil)
+	if c := (Candidate{Index: "a-2021-01-01", Storage: 50 * testGi}); !s.fit(&c) {
+		t.Fatal("expected fit without budget")
+	}
+}
+
+func TestPlanNodeBudgets(t *testing.T) {
+	opts := testOptions()
+	opts.Tasks = 4
+	opts.StorageFactor = 1
+	opts.NodeBudgets = map[string]string{"n1": "20Gi", "n2": "10Gi"}
+	r, kube := newTestReconciler(t, opts, []map[string]string{
+		{"index": "a-2021-01-01", "pri.store.size": strconv.Itoa(testGi * 8)},
+		{"index": "b-2021-01-02", "pri.store.size": strconv.Itoa(testGi * 8)},
+		{"index": "c-2021-01-03", "pri.store.size": strconv.Itoa(testGi * 5)},
+	})
+	kube.Add(ongoingJob("x-2021-01-01", "10Gi", "n1"))
+
+	plan, err := r.Plan(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"c-2021-01-03"}; !reflect.DeepEqual(plan.Deferred, want) {
+		t.Fatalf("deferred = %v, want %v", plan.Deferred, want)
+	}
+	nodes := map[string]string{}
+	for _, action := range plan.Actions {
+		if action.Kind == ActionCreateJob {
+			nodes[action.Index] = action.Job.Spec.Template.Spec.NodeSelector[hostnameLabelKey]
+		}
+	}
+	if want := map[string]string{"a-2021-01-01": "n1", "b-2021-01-02": "n2"}; !reflect.DeepEqual(nodes, want) {
+		t.Fatalf("nodes = %v, want %v", nodes, want)
+	}
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	// progressKey is the key of task progress in percent, written by esbridge to its result configmap while running
+	progressKey = "progress"
+
+	TaskStateRunning  = "running"
+	TaskStateComplete = "complete"
+	TaskStateFailed   = "failed"
+	TaskStateKept     = "kept"
+)
+
+// TaskStatus is the live state of a managed job
+type TaskStatus struct {
+	Job   string          `json:"job"`
+	Index string          `json:"index"`
+	Age   metav1.Duration `json:"age"`
+	// State is running, complete, failed or kept
+	State string `json:"state"`
+	// Phase of the latest pod, empty if no pod
+	Phase    corev1.PodPhase `json:"phase,omitempty"`
+	Node     string          `json:"node,omitempty"`
+	Restarts int32           `json:"restarts"`
+	// Storage is size of pvc, Used is bytes used on it reported by kubelet, -1 if unknown
+	Storage int64 `json:"storage"`
+	Used    int64 `json:"used"`
+	// Progress in percent reported by task, -1 if unknown
+	Progress float64 `json:"progress"`
+}
+
+// Status is what esbridgectl is doing right now
+type Status struct {
+	Time  time.Time    `json:"time"`
+	Tasks []TaskStatus `json:"tasks"`
+	// Queue are candidates waiting for a slot, in scheduling order
+	Queue []string `json:"queue"`
+	// Slots is free task slots of total
+	Slots      int `json:"slots"`
+	TotalSlots int `json:"totalSlots"`
+	// Suspicious are archives not matching their index, with reasons
+	Suspicious []string `json:"suspicious"`
+	// Quarantined are indices not archived again after too many failed tasks
+	Quarantined []string `json:"quarantined"`
+	// NotifyFailures are indices whose last outcome no notifier delivered, with errors
+	NotifyFailures []string `json:"notifyFailures"`
+}
+
+// kubeletSummary is the part of kubelet stats summary with pvc usage
+type kubeletSummary struct {
+	Pods []struct {
+		Volumes []struct {
+			UsedBytes *int64 `json:"usedBytes"`
+			PVCRef    *struct {
+				Name      string `json:"name"`
+				Namespace string `json:"namespace"`
+			} `json:"pvcRef"`
+		} `json:"volume"`
+	} `json:"pods"`
+}
+
+// volumeUsage returns used bytes of pvcs in namespace from kubelet stats summary of nodes, unavailable nodes are skipped
+func (r *Reconciler) volumeUsage(ctx context.Context, nodes []string) map[string]int64 {
+	usage := map[string]int64{}
+	for _, node := range nodes {
+		buf, err := r.Kube.CoreV1().RESTClient().Get().Resource("nodes").Name(node).SubResource("proxy").Suffix("stats/summary").DoRaw(ctx)
+		if err != nil {
+			r.log().WithError(err).With(Fields{"node": node}).Warn("Failed to get stats")
+			continue
+		}
+		var summary kubeletSummary
+		if err = json.Unmarshal(buf, &summary); err != nil {
+			r.log().WithError(err).With(Fields{"node": node}).Warn("Invalid stats")
+			continue
+		}
+		for _, pod := range summary.Pods {
+			for _, vol := range pod.Volumes {
+				if vol.PVCRef != nil && vol.UsedBytes != nil && vol.PVCRef.Namespace == r.Options.Namespace {
+					usage[vol.PVCRef.Name] = *vol.UsedBytes
+				}
+			}
+		}
+	}
+	return usage
+}
+
+// taskProgress returns progress in percent from result configmap of job, -1 if not reported
+func (r *Reconciler) taskProgress(ctx context.Context, job batchv1.Job) float64 {
+	cm, err := r.Kube.CoreV1().ConfigMaps(r.Options.Namespace).Get(ctx, resultConfigMapName(job.Name), metav1.GetOptions{})
+	if err != nil {
+		return -1
+	}
+	progress, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(cm.Data[progressKey]), "%"), 64)
+	if err != nil {
+		return -1
+	}
+	return progress
+}
+
+// Status lists managed jobs with their live state, and candidates waiting for a slot
+func (r *Reconciler) Status(ctx context.Context) (s *Status, err error) {
+	opts := r.Options
+
+	var plan *Plan
+	if plan, err = r.Plan(ctx); err != nil {
+		return
+	}
+
+	s = &Status{Time: plan.CreatedAt, Queue: plan.Queue, Slots: plan.Slots, TotalSlots: opts.Tasks}
+	if s.Queue == nil {
+		s.Queue = []string{}
+	}
+	s.Suspicious, s.Quarantined, s.NotifyFailures = plan.Suspicious, plan.Quarantined, plan.NotifyFailures
+	if s.Suspicious == nil {
+		s.Suspicious = []string{}
+	}
+	if s.Quarantined == nil {
+		s.Quarantined = []string{}
+	}
+	if s.NotifyFailures == nil {
+		s.NotifyFailures = []string{}
+	}
+	kept := map[string]bool{}
+	for _, name := range plan.Kept {
+		kept[name] = true
+	}
+
+	listOpts := metav1.ListOptions{LabelSelector: taskSelector}
+
+	var jobList *batchv1.JobList
+	if jobList, err = r.Kube.BatchV1().Jobs(opts.Namespace).List(ctx, listOpts); err != nil {
+		return
+	}
+	var podList *corev1.PodList
+	if podList, err = r.Kube.CoreV1().Pods(opts.Namespace).List(ctx, listOpts); err != nil {
+		return
+	}
+	var pvcList *corev1.PersistentVolumeClaimList
+	if pvcList, err = r.Kube.CoreV1().PersistentVolumeClaims(opts.Namespace).List(ctx, listOpts); err != nil {
+		return
+	}
+	pvcStorage := map[string]int64{}
+	for _, pvc := range pvcList.Items {
+		pvcStorage[pvc.Name] = pvc.Spec.Resources.Requests.Storage().Value()
+	}
+
+	nodeSet := map[string]bool{}
+	s.Tasks = []TaskStatus{}
+	for _, job := range jobList.Items {
+		t := TaskStatus{
+			Job:      job.Name,
+			Index:    job.Annotations[indexAnnotationKey],
+			State:    TaskStateRunning,
+			Storage:  pvcStorage[job.Name],
+			Used:     -1,
+			Progress: -1,
+		}
+		t.Age.Duration = s.Time.Sub(job.CreationTimestamp.Time).Round(time.Second)
+		for _, cond := range job.Status.Conditions {
+			if cond.Type == batchv1.JobComplete && cond.Status == corev1.ConditionTrue {
+				t.State = TaskStateComplete
+			}
+			if cond.Type == batchv1.JobFailed && cond.Status == corev1.ConditionTrue {
+				t.State = TaskStateFailed
+			}
+		}
+		if kept[job.Name] {
+			t.State = TaskStateKept
+		}
+		if pod := taskPod(job, podList.Items, ""); pod != nil {
+			t.Phase, t.Node = pod.Status.Phase, pod.Spec.NodeName
+			for _, status := range pod.Status.ContainerStatuses {
+				t.Restarts += status.RestartCount
+			}
+		}
+		if t.State == TaskStateRunning {
+			t.Progress = r.taskProgress(ctx, job)
+			if t.Node != "" {
+				nodeSet[t.Node] = true
+			}
+		}
+		if t.State == TaskStateComplete {
+			t.Progress = 100
+		}
+		s.Tasks = append(s.Tasks, t)
+	}
+
+	var nodes []string
+	for node := range nodeSet {
+		nodes = append(nodes, node)
+	}
+	sort.Strings(nodes)
+	usage := r.volumeUsage(ctx, nodes)
+	for i, t := range s.Tasks {
+		if used, ok := usage[t.Job]; ok {
+			s.Tasks[i].Used = used
+		}
+	}
+
+	sort.Slice(s.Tasks, func(i, j int) bool {
+		return s.Tasks[i].Job < s.Tasks[j].Job
+	})
+	return
+}
+
+// writeStatusTable writes status as a human readable table
+func writeStatusTable(w io.Writer, s *Status) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	_, _ = fmt.Fprintln(tw, "JOB\tINDEX\tAGE\tSTATE\tPHASE\tNODE\tPVC\tUSED\tRESTARTS\tPROGRESS")
+	for _, t := range s.Tasks {
+		phase, node, used, progress := string(t.Phase), t.Node, "-", "-"
+		if phase == "" {
+			phase = "-"
+		}
+		if node == "" {
+			node = "-"
+		}
+		if t.Used >= 0 {
+			used = formatBytes(t.Used)
+		}
+		if t.Progress >= 0 {
+			progress = strconv.FormatFloat(t.Progress, 'f', 1, 64) + "%"
+		}
+		_, _ = fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\t%s\t%d\t%s\n",
+			t.Job, t.Index, t.Age.Duration.String(), t.State, phase, node, formatBytes(t.Storage), used, t.Restarts, progress)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	queue := "-"
+	if len(s.Queue) > 0 {
+		queue = strings.Join(s.Queue, ", ")
+	}
+	if _, err := fmt.Fprintf(w, "\nSLOTS: %d/%d free\nQUEUE (%d): %s\n", s.Slots, s.TotalSlots, len(s.Queue), queue); err != nil {
+		return err
+	}
+	for _, item := range s.Suspicious {
+		if _, err := fmt.Fprintf(w, "SUSPICIOUS: %s\n", item); err != nil {
+			return err
+		}
+	}
+	for _, index := range s.Quarantined {
+		if _, err := fmt.Fprintf(w, "QUARANTINED: %s\n", index); err != nil {
+			return err
+		}
+	}
+	for _, failure := range s.NotifyFailures {
+		if _, err := fmt.Fprintf(w, "NOTIFY FAILED: %s\n", failure); err != nil {
+			return err
+		}
+	}
+	return nil
+}
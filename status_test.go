@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testStatsSummary = `{"pods": [{"podRef": {"name": "task-a-2021-01-01-xxxxx"}, "volume": [
+	{"name": "vol-cfg"},
+	{"name": "vol-data", "usedBytes": 1073741824, "pvcRef": {"name": "task-a-2021-01-01", "namespace": "esmaint"}},
+	{"name": "other", "usedBytes": 1, "pvcRef": {"name": "task-a-2021-01-01", "namespace": "other"}}
+]}]}`
+
+func TestReconcilerStatus(t *testing.T) {
+	opts := testOptions()
+	opts.Tasks = 3
+	opts.KeepFailed.Duration = time.Hour * 24 * 365
+	r, kube := newTestReconciler(t, opts, []map[string]string{
+		{"index": "a-2021-01-01"},
+		{"index": "b-2021-01-01"},
+		{"index": "c-2021-01-01"},
+		{"index": "d-2021-01-01"},
+		{"index": "e-2021-01-02"},
+	})
+
+	kube.Add(ongoingJob("a-2021-01-01", "", ""))
+	pvc := &corev1.PersistentVolumeClaim{ObjectMeta: taskObjectMeta("task-a-2021-01-01", "a-2021-01-01")}
+	pvc.Spec.Resources.Requests = corev1.ResourceList{corev1.ResourceStorage: resource.MustParse("10Gi")}
+	kube.Add(pvc)
+	pod := &corev1.Pod{ObjectMeta: taskObjectMeta("task-a-2021-01-01-xxxxx", "a-2021-01-01")}
+	pod.Labels["job-name"] = "task-a-2021-01-01"
+	pod.Spec.NodeName = "node-1"
+	pod.Status.Phase = corev1.PodRunning
+	pod.Status.ContainerStatuses = []corev1.ContainerStatus{{Name: "task", RestartCount: 1}}
+	kube.Add(pod)
+	cm := resultConfigMap("a-2021-01-01", "")
+	cm.Data = map[string]string{progressKey: "42.5"}
+	kube.Add(cm)
+	kube.SetStats("node-1", testStatsSummary)
+	kube.Add(finishedJob("b-2021-01-01", batchv1.JobFailed))
+
+	s, err := r.Status(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(s.Tasks) != 2 {
+		t.Fatalf("tasks = %+v", s.Tasks)
+	}
+	a, b := s.Tasks[0], s.Tasks[1]
+	if a.State != TaskStateRunning || a.Phase != corev1.PodRunning || a.Node != "node-1" || a.Restarts != 1 ||
+		a.Storage != 10*testGi || a.Used != testGi || a.Progress != 42.5 || a.Age.Duration != r.Now().Sub(time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Fatalf("task a = %+v", a)
+	}
+	if b.State != TaskStateKept || b.Phase != "" || b.Used != -1 || b.Progress != -1 {
+		t.Fatalf("task b = %+v", b)
+	}
+	if want := []string{"c-2021-01-01", "d-2021-01-01", "e-2021-01-02"}; !reflect.DeepEqual(s.Queue, want) || s.Slots != 2 || s.TotalSlots != 3 {
+		t.Fatalf("queue = %v, slots = %d/%d", s.Queue, s.Slots, s.TotalSlots)
+	}
+
+	buf := &bytes.Buffer{}
+	if err = writeStatusTable(buf, s); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(buf.String(), "\n")
+	if fields := strings.Fields(lines[1]); strings.Join(fields[3:], " ") != "running Running node-1 10.0Gi 1.0Gi 1 42.5%" {
+		t.Fatalf("row = %s", lines[1])
+	}
+	if !strings.Contains(buf.String(), "SLOTS: 2/3 free\nQUEUE (3): c-2021-01-01, d-2021-01-01, e-2021-01-02\n") {
+		t.Fatalf("table = %s", buf.String())
+	}
+
+	// status never changes anything
+	if want := []string{"task-a-2021-01-01", "task-b-2021-01-01"}; !reflect.DeepEqual(kube.Names("jobs"), want) {
+		t.Fatalf("jobs = %v, want %v", kube.Names("jobs"), want)
+	}
+}
+
+func TestReconcilerStatusReportsArchiveProblems(t *testing.T) {
+	r, _ := newTestReconciler(t, testOptions(), []map[string]string{
+		{"index": "a-2021-01-01"},
+		{"index": "b-2021-01-01"},
+	})
+	for _, rec := range []LedgerRecord{
+		{Index: "a-2021-01-01", Outcome: OutcomeComplete, Verification: VerificationSuspicious, Reason: "archived 41 docs, index has 42"},
+		{Index: "b-2021-01-01", Outcome: OutcomeFailed, Failures: 5, Quarantined: true},
+	} {
+		if err := r.ledger().Put(context.Background(), rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s, err := r.Status(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"a-2021-01-01: archived 41 docs, index has 42"}; !reflect.DeepEqual(s.Suspicious, want) {
+		t.Fatalf("suspicious = %v, want %v", s.Suspicious, want)
+	}
+	if want := []string{"b-2021-01-01"}; !reflect.DeepEqual(s.Quarantined, want) {
+		t.Fatalf("quarantined = %v, want %v", s.Quarantined, want)
+	}
+
+	buf := &bytes.Buffer{}
+	if err = writeStatusTable(buf, s); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "SUSPICIOUS: a-2021-01-01: archived 41 docs, index has 42\nQUARANTINED: b-2021-01-01\n") {
+		t.Fatalf("table = %s", buf.String())
+	}
+}
@@ -1,33 +1,68 @@
 package main
 
 import (
-	"path/filepath"
-	"regexp"
-	"sort"
+	"context"
+	"encoding/json"
+	"fmt"
+	"sigs.k8s.io/yaml"
 	"strconv"
 	"strings"
 	"time"
 )
 
-var (
-	indexDatePattern = regexp.MustCompile(`(\d{4})[._-]?(\d{2})[._-]?(\d{2})$`)
-)
+func dateMidnight(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, t.Location())
+}
 
-func dateFromIndex(index string) (date time.Time, ok bool) {
-	matches := indexDatePattern.FindStringSubmatch(filepath.Base(index))
-	if len(matches) == 0 {
-		return
+// daysBetween returns calendar days from date of a to date of b, not affected by daylight saving
+func daysBetween(a, b time.Time) int {
+	da := time.Date(a.Year(), a.Month(), a.Day(), 0, 0, 0, 0, time.UTC)
+	db := time.Date(b.Year(), b.Month(), b.Day(), 0, 0, 0, 0, time.UTC)
+	return int(db.Sub(da) / (time.Hour * 24))
+}
+
+// formatBytes formats n bytes in binary units, like 1.5Gi
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return strconv.FormatInt(n, 10)
 	}
-	year, _ := strconv.Atoi(matches[1])
-	month, _ := strconv.Atoi(matches[2])
-	day, _ := strconv.Atoi(matches[3])
-	date = time.Date(year, time.Month(month), day, 0, 0, 0, 0, time.Local)
-	ok = true
-	return
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return strconv.FormatFloat(float64(n)/float64(div), 'f', 1, 64) + string("KMGTPE"[exp]) + "i"
 }
 
-func dateMidnight(t time.Time) time.Time {
-	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.Local)
+func taskNameFromIndex(index string) string {
+	return taskPrefix + strings.ReplaceAll(strings.ReplaceAll(index, "_", "-"), ".", "-")
+}
+
+// sleepContext sleeps for d, returns early with error if ctx is done
+func sleepContext(ctx context.Context, d time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
+
+// marshalOutput marshals v as json or yaml
+func marshalOutput(v interface{}, format string) (buf []byte, err error) {
+	switch format {
+	case "json":
+		if buf, err = json.MarshalIndent(v, "", "  "); err != nil {
+			return
+		}
+		buf = append(buf, '\n')
+	case "yaml":
+		buf, err = yaml.Marshal(v)
+	default:
+		err = fmt.Errorf("unknown output format: %s", format)
+	}
+	return
 }
 
 func removeFromStrSlice(indices []string, index string) []string {
@@ -41,32 +76,32 @@ func removeFromStrSlice(indices []string, index string) []string {
 	return out
 }
 
-var (
-	deferIndices = []string{
-		"info-prod-",
-		"info-production-",
-		"access-prod-",
-		"access-production-",
-		"-prod",
+func containsStr(items []string, item string) bool {
+	for _, item0 := range items {
+		if item0 == item {
+			return true
+		}
 	}
-)
+	return false
+}
 
-func sortCandidateIndices(indices []string) {
-	sort.SliceStable(indices, func(i, j int) bool {
-		for _, di := range deferIndices {
-			if strings.Contains(strings.ToLower(indices[j]), di) {
-				if !strings.Contains(strings.ToLower(indices[i]), di) {
-					return true
-				}
-			} else {
-				if strings.Contains(strings.ToLower(indices[i]), di) {
-					return false
-				}
-			}
+// diffStrSlices returns items only in b as added, and items only in a as removed
+func diffStrSlices(a, b []string) (added []string, removed []string) {
+	inA := map[string]bool{}
+	for _, item := range a {
+		inA[item] = true
+	}
+	inB := map[string]bool{}
+	for _, item := range b {
+		inB[item] = true
+		if !inA[item] {
+			added = append(added, item)
 		}
-		if len(indices[i]) > 10 && len(indices[j]) > 10 {
-			return indices[j][len(indices[j])-10:] > indices[i][len(indices[i])-10:]
+	}
+	for _, item := range a {
+		if !inB[item] {
+			removed = append(removed, item)
 		}
-		return indices[j] > indices[i]
-	})
+	}
+	return
 }
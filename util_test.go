@@ -4,17 +4,16 @@ import (
 	"testing"
 )
 
-func TestSortProd(t *testing.T) {
-	ss := []string{
-		"info-prod-2021-03-02",
-		"info-prod-2021-03-01",
-		"access-prod-2021-03-02",
-		"access-prod-2021-03-01",
-		"warn-prod-2021-03-02",
-		"warn-prod-2021-03-01",
-		"access-test-2021-03-02",
-		"access-test-2021-03-01",
+func TestFormatBytes(t *testing.T) {
+	for n, want := range map[int64]string{
+		0:                      "0",
+		1023:                   "1023",
+		1536:                   "1.5Ki",
+		200 * 1024 * 1024:      "200.0Mi",
+		3 * 1024 * 1024 * 1024: "3.0Gi",
+	} {
+		if got := formatBytes(n); got != want {
+			t.Errorf("formatBytes(%d) = %s, want %s", n, got, want)
+		}
 	}
-	sortCandidateIndices(ss)
-	t.Log(ss)
 }